@@ -0,0 +1,109 @@
+// assets.go
+// This file contains cache busting for static files. AssetURL names a file
+// after a hash of its content, e.g. "/app.3f2a9c1b.js" for "/app.js". The
+// static file server maps such names back to the file and lets clients cache
+// it for good, since a changed file gets a new URL.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// staticRoot is the directory the static file server serves from.
+const staticRoot = "public"
+
+// assetHashLen is the number of hex digits of the content hash put in asset URLs.
+const assetHashLen = 8
+
+// immutableCacheControl lets clients cache a response for a year without
+// ever revalidating it.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+type assetHash struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+// assetHashes caches file hashes, so a file is only read again once it changed.
+var assetHashes = struct {
+	sync.Mutex
+	m map[string]assetHash
+}{m: make(map[string]assetHash)}
+
+// contentHash returns the hash of the file's content used in its asset URL.
+func contentHash(filePath string) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	assetHashes.Lock()
+	cached, ok := assetHashes.m[filePath]
+	assetHashes.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.hash, nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))[:assetHashLen]
+
+	assetHashes.Lock()
+	assetHashes.m[filePath] = assetHash{modTime: info.ModTime(), size: info.Size(), hash: hash}
+	assetHashes.Unlock()
+	return hash, nil
+}
+
+// AssetURL returns the cache-busting URL of the static file at urlPath, with
+// the content hash put before the extension: "/css/site.css" becomes
+// "/css/site.1a2b3c4d.css". Only files with an extension can be addressed
+// this way.
+func AssetURL(urlPath string) (string, error) {
+	cleanPath := filepath.Clean(strings.TrimPrefix(urlPath, "/"))
+	if strings.HasPrefix(cleanPath, "..") {
+		return "", fmt.Errorf("asset %q is outside the static root", urlPath)
+	}
+	ext := filepath.Ext(cleanPath)
+	if ext == "" {
+		return "", fmt.Errorf("asset %q has no extension", urlPath)
+	}
+	hash, err := contentHash(filepath.Join(staticRoot, cleanPath))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(urlPath, ext) + "." + hash + ext, nil
+}
+
+// resolveHashedAsset maps a name made by AssetURL back to the file it stands
+// for. ok is false if the name has no hash, or the hash doesn't match what
+// the file holds now; an old URL must not get the new content cached forever.
+func resolveHashedAsset(cleanPath string) (filePath string, ok bool) {
+	ext := filepath.Ext(cleanPath)
+	stem := strings.TrimSuffix(cleanPath, ext)
+	dot := strings.LastIndex(stem, ".")
+	if ext == "" || dot < 0 || len(stem)-dot-1 != assetHashLen {
+		return "", false
+	}
+	filePath = filepath.Join(staticRoot, stem[:dot]+ext)
+	hash, err := contentHash(filePath)
+	if err != nil || hash != stem[dot+1:] {
+		return "", false
+	}
+	return filePath, true
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestAssetURL(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll(filepath.Join(staticRoot, "js"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(staticRoot, "js", "app.js")
+	if err := os.WriteFile(file, []byte("console.log(1)"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) *StoredResponse {
+		return serveRecorded(serveStaticFile, newTestRequest("GET", path, nil, ""))
+	}
+
+	url, err := AssetURL("/js/app.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^/js/app\.[0-9a-f]{8}\.js$`).MatchString(url) {
+		t.Fatalf("AssetURL = %q, want /js/app.<hash>.js", url)
+	}
+	res := get(url)
+	if res.Status != 200 || string(res.Body) != "console.log(1)" {
+		t.Fatalf("hashed URL: response = %d %q, want the file", res.Status, res.Body)
+	}
+	if cc := res.Headers["Cache-Control"]; cc != immutableCacheControl {
+		t.Errorf("hashed URL: Cache-Control = %q, want %q", cc, immutableCacheControl)
+	}
+	if res := get("/js/app.js"); res.Status != 200 || res.Headers["Cache-Control"] == immutableCacheControl {
+		t.Errorf("plain URL: response = %d with Cache-Control %q, want it served without immutable caching", res.Status, res.Headers["Cache-Control"])
+	}
+	if res := get("/js/app.00000000.js"); res.Status != 404 {
+		t.Errorf("wrong hash: status = %d, want 404", res.Status)
+	}
+
+	// Once the file changes, its URL does too, and the old one is gone.
+	if err := os.WriteFile(file, []byte("console.log(2)"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Second))
+	newURL, err := AssetURL("/js/app.js")
+	if err != nil || newURL == url {
+		t.Fatalf("AssetURL after change = %q, %v; want a new URL", newURL, err)
+	}
+	if res := get(url); res.Status != 404 {
+		t.Errorf("old URL: status = %d, want 404", res.Status)
+	}
+	if res := get(newURL); string(res.Body) != "console.log(2)" {
+		t.Errorf("new URL: body = %q", res.Body)
+	}
+
+	for _, bad := range []string{"/../secret.js", "/js/app"} {
+		if _, err := AssetURL(bad); err == nil {
+			t.Errorf("AssetURL(%q) succeeded, want an error", bad)
+		}
+	}
+}
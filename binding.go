@@ -0,0 +1,144 @@
+// binding.go
+// This file contains helpers that copy request values into a struct, so
+// handlers can declare the parameters they expect instead of reading each
+// one by hand. Fields are matched using struct tags.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// BindQuery populates the struct pointed to by v from the query string.
+// Fields are matched by their `query:"name"` tag; untagged fields are left
+// alone. Supported field types are strings, bools, integers, floats and
+// slices of those. A value that can't be converted returns an error.
+func (r *Request) BindQuery(v any) error {
+	return bindValues(v, r.query, "query")
+}
+
+// BindForm populates the struct pointed to by v from a urlencoded or
+// multipart form body, matching fields by their `form:"name"` tag. Adding
+// ",required" to the tag (e.g. `form:"email,required"`) makes a missing or
+// empty field an error.
+func (r *Request) BindForm(v any) error {
+	form, err := r.ParseForm()
+	if err != nil {
+		return err
+	}
+	return bindValues(v, form, "form")
+}
+
+// ParseBody decodes the request body into v according to its Content-Type:
+// JSON is unmarshaled into v (a struct or map pointer), while urlencoded and
+// multipart forms fill a *url.Values or are bound to a struct like BindForm.
+// Other content types return an error.
+func (r *Request) ParseBody(v any) error {
+	mediaType, _, err := mime.ParseMediaType(r.Headers["Content-Type"])
+	if err != nil {
+		return fmt.Errorf("invalid Content-Type: %v", err)
+	}
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return json.NewDecoder(r.BodyReader()).Decode(v)
+	case mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data":
+		form, err := r.ParseForm()
+		if err != nil {
+			return err
+		}
+		if values, ok := v.(*url.Values); ok {
+			*values = form
+			return nil
+		}
+		return bindValues(v, form, "form")
+	default:
+		return fmt.Errorf("unsupported Content-Type %q", mediaType)
+	}
+}
+
+// bindValues sets every field of the struct pointed to by v that carries the
+// given tag from the matching entry in values. A field whose tag has the
+// "required" option must be present with a non-empty value.
+func bindValues(v any, values url.Values, tag string) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("bind: expected a pointer to a struct, got %T", v)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get(tag), ",")
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+		vals, ok := values[name]
+		if !ok || len(vals) == 0 || (len(vals) == 1 && vals[0] == "") {
+			if opts == "required" {
+				return fmt.Errorf("bind: %s %q is required", tag, name)
+			}
+			continue
+		}
+		if err := setField(rv.Field(i), vals); err != nil {
+			return fmt.Errorf("bind: %s %q: %v", tag, name, err)
+		}
+	}
+	return nil
+}
+
+// setField converts vals to the field's type. Slices take every value; any
+// other kind takes the first.
+func setField(field reflect.Value, vals []string) error {
+	if field.Kind() == reflect.Slice {
+		slice := reflect.MakeSlice(field.Type(), len(vals), len(vals))
+		for i, val := range vals {
+			if err := setScalar(slice.Index(i), val); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+	return setScalar(field, vals[0])
+}
+
+func setScalar(field reflect.Value, val string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("invalid bool %q", val)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(val, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", val)
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(val, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer %q", val)
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(val, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", val)
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/textproto"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestRequest builds a request for target with the given headers and
+// body, the way parseRequest would.
+func newTestRequest(method, target string, headers map[string]string, body string) *Request {
+	r := &Request{Method: method, Version: "HTTP/1.1", Headers: make(map[string]string)}
+	for name, value := range headers {
+		r.Headers[textproto.CanonicalMIMEHeaderKey(name)] = value
+	}
+	r.setTarget(target)
+	if body != "" {
+		r.body = strings.NewReader(body)
+	}
+	return r
+}
+
+func TestBindQuery(t *testing.T) {
+	var params struct {
+		Page    int      `query:"page"`
+		Tags    []string `query:"tags"`
+		Draft   bool     `query:"draft"`
+		Ignored string
+	}
+	r := newTestRequest("GET", "/posts?page=2&tags=a&tags=b&draft=true&Ignored=x", nil, "")
+	if err := r.BindQuery(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params.Page != 2 || !reflect.DeepEqual(params.Tags, []string{"a", "b"}) || !params.Draft || params.Ignored != "" {
+		t.Errorf("bound %+v", params)
+	}
+}
+
+func TestBindQueryErrors(t *testing.T) {
+	var params struct {
+		Page int `query:"page"`
+	}
+	r := newTestRequest("GET", "/posts?page=two", nil, "")
+	if err := r.BindQuery(&params); err == nil {
+		t.Error("page=two bound without an error")
+	}
+	if err := r.BindQuery(params); err == nil {
+		t.Error("binding into a non-pointer didn't fail")
+	}
+}
+
+type signupForm struct {
+	Email string `form:"email,required"`
+	Age   int    `form:"age"`
+	Terms bool   `form:"terms"`
+}
+
+func TestBindForm(t *testing.T) {
+	r := newTestRequest("POST", "/signup", map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	}, "email=a%40example.com&age=30&terms=on")
+	var form signupForm
+	err := r.BindForm(&form)
+	// "on" is what browsers send for a checked box, but not a bool.
+	if err == nil || !strings.Contains(err.Error(), "terms") {
+		t.Fatalf("err = %v, want an error about terms", err)
+	}
+
+	r = newTestRequest("POST", "/signup", map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	}, "email=a%40example.com&age=30&terms=true")
+	form = signupForm{}
+	if err := r.BindForm(&form); err != nil {
+		t.Fatal(err)
+	}
+	if form != (signupForm{Email: "a@example.com", Age: 30, Terms: true}) {
+		t.Errorf("bound %+v", form)
+	}
+}
+
+func TestBindFormMultipart(t *testing.T) {
+	body := "--XX\r\nContent-Disposition: form-data; name=\"email\"\r\n\r\nb@example.com\r\n" +
+		"--XX\r\nContent-Disposition: form-data; name=\"age\"\r\n\r\n41\r\n--XX--\r\n"
+	r := newTestRequest("POST", "/signup", map[string]string{
+		"Content-Type": "multipart/form-data; boundary=XX",
+	}, body)
+	var form signupForm
+	if err := r.BindForm(&form); err != nil {
+		t.Fatal(err)
+	}
+	if form.Email != "b@example.com" || form.Age != 41 {
+		t.Errorf("bound %+v", form)
+	}
+}
+
+func TestBindFormRequired(t *testing.T) {
+	for _, body := range []string{"age=30", "email=&age=30"} {
+		r := newTestRequest("POST", "/signup", map[string]string{
+			"Content-Type": "application/x-www-form-urlencoded",
+		}, body)
+		var form signupForm
+		err := r.BindForm(&form)
+		if err == nil || !strings.Contains(err.Error(), `"email" is required`) {
+			t.Errorf("%s: err = %v, want email required", body, err)
+		}
+	}
+}
+
+func TestParseBody(t *testing.T) {
+	t.Run("JSON struct", func(t *testing.T) {
+		r := newTestRequest("POST", "/", map[string]string{"Content-Type": "application/json; charset=utf-8"}, `{"email":"a@example.com","age":30}`)
+		var got struct {
+			Email string `json:"email"`
+			Age   int    `json:"age"`
+		}
+		if err := r.ParseBody(&got); err != nil || got.Email != "a@example.com" || got.Age != 30 {
+			t.Errorf("ParseBody = %v, got %+v", err, got)
+		}
+	})
+
+	t.Run("JSON map", func(t *testing.T) {
+		r := newTestRequest("POST", "/", map[string]string{"Content-Type": "application/merge-patch+json"}, `{"name":"x"}`)
+		var got map[string]any
+		if err := r.ParseBody(&got); err != nil || got["name"] != "x" {
+			t.Errorf("ParseBody = %v, got %v", err, got)
+		}
+	})
+
+	t.Run("form struct", func(t *testing.T) {
+		r := newTestRequest("POST", "/", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, "email=a%40example.com&age=30")
+		var got signupForm
+		if err := r.ParseBody(&got); err != nil || got != (signupForm{Email: "a@example.com", Age: 30}) {
+			t.Errorf("ParseBody = %v, got %+v", err, got)
+		}
+	})
+
+	t.Run("form values", func(t *testing.T) {
+		r := newTestRequest("POST", "/", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, "tag=a&tag=b")
+		var got url.Values
+		if err := r.ParseBody(&got); err != nil || !reflect.DeepEqual(got["tag"], []string{"a", "b"}) {
+			t.Errorf("ParseBody = %v, got %v", err, got)
+		}
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		body := "--XX\r\nContent-Disposition: form-data; name=\"email\"\r\n\r\nb@example.com\r\n--XX--\r\n"
+		r := newTestRequest("POST", "/", map[string]string{"Content-Type": "multipart/form-data; boundary=XX"}, body)
+		var got signupForm
+		if err := r.ParseBody(&got); err != nil || got.Email != "b@example.com" {
+			t.Errorf("ParseBody = %v, got %+v", err, got)
+		}
+	})
+
+	for _, contentType := range []string{"text/plain", "application/xml", ""} {
+		r := newTestRequest("POST", "/", map[string]string{"Content-Type": contentType}, "data")
+		var got map[string]any
+		if err := r.ParseBody(&got); err == nil {
+			t.Errorf("Content-Type %q: ParseBody succeeded, want an error", contentType)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+// body.go
+// This file contains everything related to reading a request body. Bodies
+// are not read up front by parseRequest; they stay on the connection until a
+// handler asks for them, so large uploads can be streamed instead of held in
+// memory. Chunked request bodies are decoded here as well.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBodyTooLarge is returned when reading a request body past the server's
+// MaxBodySize.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// Body reads and returns the whole request body. It is read from the
+// connection on first use and cached, so it can be called any number of times.
+// Use BodyReader or CopyBodyTo instead for bodies that shouldn't be held in memory.
+func (r *Request) Body() string {
+	if !r.bodyCached {
+		data, err := io.ReadAll(r.BodyReader())
+		if err != nil {
+			log.Printf("Error reading request body: %v", err)
+		}
+		r.bodyText = string(data)
+		r.bodyCached = true
+	}
+	return r.bodyText
+}
+
+// BodyReader returns a reader that streams the request body straight off the
+// connection. The body can only be streamed once, unless Body or
+// RewindableBodyMiddleware has read it already; then every call returns a
+// new reader starting at the beginning.
+func (r *Request) BodyReader() io.Reader {
+	if r.bodyCached {
+		return strings.NewReader(r.bodyText)
+	}
+	if r.body == nil {
+		return strings.NewReader("")
+	}
+	return r.body
+}
+
+// CopyBodyTo streams the request body into dst without buffering it, and
+// returns the number of bytes copied.
+func (r *Request) CopyBodyTo(dst io.Writer) (int64, error) {
+	return io.Copy(dst, r.BodyReader())
+}
+
+// MaxBytesReader limits the rest of the request body to n bytes for
+// everything that reads it afterwards, including Body and CopyBodyTo, and
+// returns the limited reader. It guards handlers against bodies larger than
+// they are prepared to handle, whatever the server-wide MaxBodySize is.
+// Reading past the limit fails with ErrBodyTooLarge and answers the request
+// with 413; the connection is closed afterwards since the body wasn't consumed.
+// A body whose declared Content-Length is already over the limit fails on
+// the first read without reading anything, so a client waiting on
+// "Expect: 100-continue" is never told to send it.
+func MaxBytesReader(w ResponseWriter, r *Request, n int64) io.Reader {
+	mr := &maxBytesReader{w: w, req: r, limited: limitedBody{r: r.BodyReader(), n: n}}
+	if declared, err := strconv.ParseInt(r.Headers["Content-Length"], 10, 64); err == nil && declared > n && !r.bodyCached {
+		mr.declaredTooLarge = true
+	}
+	r.body, r.bodyCached = mr, false
+	return mr
+}
+
+type maxBytesReader struct {
+	w        ResponseWriter
+	req      *Request
+	limited  limitedBody
+	rejected bool
+
+	declaredTooLarge bool // The Content-Length is over the limit.
+}
+
+func (mr *maxBytesReader) Read(p []byte) (int, error) {
+	n, err := 0, ErrBodyTooLarge
+	if !mr.declaredTooLarge {
+		n, err = mr.limited.Read(p)
+	}
+	if err == ErrBodyTooLarge && !mr.rejected {
+		mr.rejected = true
+		mr.w.SetHeader("Connection", "close")
+		httpError(mr.w, mr.req, 413)
+	}
+	return n, err
+}
+
+// RewindableBodyMiddleware reads the request body into memory before the
+// rest of the chain runs, so middleware and handler can each read it in full,
+// e.g. to verify a signature over it, through Body or BodyReader. A body over
+// maxBytes is answered with 413 and the connection closed.
+func RewindableBodyMiddleware(maxBytes int64) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			data, err := io.ReadAll(io.LimitReader(r.BodyReader(), maxBytes+1))
+			if err == nil && int64(len(data)) > maxBytes {
+				err = ErrBodyTooLarge
+			}
+			if err != nil {
+				log.Printf("Error buffering request body: %v", err)
+				w.SetHeader("Connection", "close")
+				if err == ErrBodyTooLarge {
+					httpError(w, r, 413)
+				} else {
+					httpError(w, r, 400)
+				}
+				return
+			}
+			r.bodyText, r.bodyCached = string(data), true
+			next(w, r)
+		}
+	}
+}
+
+// maxDrainBytes is how much of an unread body is discarded to keep a
+// connection alive. Past that, closing the connection is cheaper.
+const maxDrainBytes = 256 << 10
+
+// discardBody reads and throws away whatever the handler left of the body so
+// the next request on the connection can be parsed. It reports whether the
+// connection can be reused.
+func (r *Request) discardBody() bool {
+	if r.body == nil {
+		return true
+	}
+	// Draining isn't the handler reading the body, so the limits set with
+	// MaxBytesReader, and the 413 that comes with them, don't apply. A body
+	// declared larger than the handler allows isn't worth draining either.
+	body := r.body
+	for {
+		mr, ok := body.(*maxBytesReader)
+		if !ok {
+			break
+		}
+		if mr.declaredTooLarge {
+			return false
+		}
+		body = mr.limited.r
+	}
+	// The client is still waiting for permission to send the body, and may
+	// never send it.
+	if cr, ok := body.(*continueReader); ok && !cr.sent {
+		return false
+	}
+	n, err := io.CopyN(io.Discard, body, maxDrainBytes+1)
+	return err == io.EOF && n <= maxDrainBytes
+}
+
+// countingReader counts the bytes read through it into n.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	*cr.n += int64(n)
+	return n, err
+}
+
+// bodySize returns the size of the request body: its Content-Length, or for
+// a chunked body as much of it as has been read so far.
+func (r *Request) bodySize() int64 {
+	// Trailers is only set up for chunked bodies.
+	if r.Trailers != nil {
+		return r.bodyRead
+	}
+	n, _ := strconv.ParseInt(r.Headers["Content-Length"], 10, 64)
+	return n
+}
+
+// idleTimeoutReader reads a request body off conn with a fresh read
+// deadline of bodyReadTimeout for every read, so only a client that stops
+// sending is cut off, not a large upload that takes a while.
+type idleTimeoutReader struct {
+	conn net.Conn
+	r    io.Reader
+}
+
+func (ir *idleTimeoutReader) Read(p []byte) (int, error) {
+	ir.conn.SetReadDeadline(time.Now().Add(bodyReadTimeout))
+	return ir.r.Read(p)
+}
+
+// continueReader sends "100 Continue" to the client the first time the body is read.
+type continueReader struct {
+	r    io.Reader
+	conn io.Writer
+	resp *response // The response to the request, once it has been set up.
+	sent bool
+}
+
+func (cr *continueReader) Read(p []byte) (int, error) {
+	if !cr.sent {
+		cr.sent = true
+		if err := cr.sendContinue(); err != nil {
+			return 0, err
+		}
+	}
+	return cr.r.Read(p)
+}
+
+// sendContinue tells the client to go ahead with the body, unless the final
+// response headers have gone out already: no interim response may follow
+// them. The client might still send the body or might not, so then the
+// connection is closed after the response instead.
+func (cr *continueReader) sendContinue() error {
+	if cr.resp != nil {
+		cr.resp.mu.Lock()
+		defer cr.resp.mu.Unlock()
+		if cr.resp.sentHeader {
+			cr.resp.closeConn = true
+			return nil
+		}
+	}
+	_, err := io.WriteString(cr.conn, "HTTP/1.1 100 Continue\r\n\r\n")
+	return err
+}
+
+// maxChunkLineBytes caps a chunk-size line, extensions included, and
+// maxTrailerBytes the whole trailer section. Neither has any use for more,
+// and without a cap a client could make the server buffer a line forever.
+const (
+	maxChunkLineBytes = 4 << 10
+	maxTrailerBytes   = 16 << 10
+)
+
+// chunkedReader decodes a body sent with Transfer-Encoding: chunked.
+type chunkedReader struct {
+	r        *bufio.Reader
+	n        int64             // Bytes left in the current chunk.
+	err      error             // Sticky; set once the body is done or broken.
+	trailers map[string]string // Receives the trailer section.
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.n == 0 {
+		cr.n, cr.err = cr.nextChunk()
+		if cr.err != nil {
+			return 0, cr.err
+		}
+	}
+	if int64(len(p)) > cr.n {
+		p = p[:cr.n]
+	}
+	n, err := cr.r.Read(p)
+	cr.n -= int64(n)
+	if err == nil && cr.n == 0 {
+		// Every chunk's data is followed by a CRLF.
+		var line string
+		line, err = readLine(cr.r, maxChunkLineBytes)
+		if err == errLineTooLong || err == nil && strings.TrimSpace(line) != "" {
+			err = fmt.Errorf("malformed chunk terminator")
+		}
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	cr.err = err
+	return n, err
+}
+
+// nextChunk reads a chunk-size line. The last chunk has a size of zero and is
+// followed by the trailer section, which ends with an empty line. Trailer
+// fields are collected into cr.trailers.
+func (cr *chunkedReader) nextChunk() (int64, error) {
+	line, err := readLine(cr.r, maxChunkLineBytes)
+	if err == errLineTooLong {
+		return 0, fmt.Errorf("chunk size line exceeds %d bytes", maxChunkLineBytes)
+	}
+	if err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	line = strings.TrimSpace(line)
+	// Chunk extensions aren't used by anything, so they are dropped.
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	size, err := strconv.ParseInt(line, 16, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("malformed chunk size %q", line)
+	}
+	if size > 0 {
+		return size, nil
+	}
+	// Each trailer line is read only as far as what is left of the budget.
+	trailerBytes := 0
+	for {
+		line, err := readLine(cr.r, maxTrailerBytes-trailerBytes)
+		if err == errLineTooLong {
+			return 0, fmt.Errorf("trailers exceed %d bytes", maxTrailerBytes)
+		}
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		trailerBytes += len(line)
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return 0, io.EOF
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && cr.trailers != nil {
+			cr.trailers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+}
+
+// limitedBody fails with ErrBodyTooLarge once more than n bytes have been read.
+// Unlike io.LimitReader it reports the overflow instead of silently stopping.
+type limitedBody struct {
+	r io.Reader
+	n int64 // Bytes still allowed.
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Only an error if there really is more data.
+		var probe [1]byte
+		if n, err := l.r.Read(probe[:]); n == 0 {
+			return 0, err
+		}
+		return 0, ErrBodyTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopyBodyTo(t *testing.T) {
+	payload := make([]byte, 3<<20)
+	rand.Read(payload)
+
+	s := NewServer("")
+	copied := make(chan []byte, 1)
+	s.Handle("POST", "/buffer", func(w ResponseWriter, r *Request) {
+		var buf bytes.Buffer
+		n, err := r.CopyBodyTo(&buf)
+		if err != nil {
+			httpError(w, r, 500)
+			return
+		}
+		copied <- buf.Bytes()
+		fmt.Fprint(w, n)
+	})
+	file := filepath.Join(t.TempDir(), "upload")
+	s.Handle("POST", "/file", func(w ResponseWriter, r *Request) {
+		f, err := os.Create(file)
+		if err != nil {
+			httpError(w, r, 500)
+			return
+		}
+		defer f.Close()
+		n, err := r.CopyBodyTo(f)
+		if err != nil {
+			httpError(w, r, 500)
+			return
+		}
+		fmt.Fprint(w, n)
+	})
+	addr := startServer(t, s)
+
+	t.Run("buffer", func(t *testing.T) {
+		resp, err := http.Post("http://"+addr+"/buffer", "application/octet-stream", bytes.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		got := <-copied
+		if resp.StatusCode != 200 || !bytes.Equal(got, payload) {
+			t.Errorf("status %d, copied %d bytes intact: %v", resp.StatusCode, len(got), bytes.Equal(got, payload))
+		}
+	})
+	t.Run("file", func(t *testing.T) {
+		resp, err := http.Post("http://"+addr+"/file", "application/octet-stream", bytes.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 || !bytes.Equal(data, payload) {
+			t.Errorf("status %d, file has %d bytes intact: %v", resp.StatusCode, len(data), bytes.Equal(data, payload))
+		}
+	})
+	t.Run("chunked", func(t *testing.T) {
+		// Hiding the length makes net/http send the body chunked.
+		body := struct{ *bytes.Reader }{bytes.NewReader(payload)}
+		resp, err := http.Post("http://"+addr+"/buffer", "application/octet-stream", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		got := <-copied
+		if resp.StatusCode != 200 || !bytes.Equal(got, payload) {
+			t.Errorf("status %d, copied %d bytes intact: %v", resp.StatusCode, len(got), bytes.Equal(got, payload))
+		}
+	})
+}
+
+func TestCopyBodyToMaxBodySize(t *testing.T) {
+	s := NewServer("")
+	s.MaxBodySize = 1000
+	copyErr := make(chan error, 1)
+	s.Handle("POST", "/", func(w ResponseWriter, r *Request) {
+		_, err := r.CopyBodyTo(&bytes.Buffer{})
+		copyErr <- err
+	})
+	addr := startServer(t, s)
+
+	// A declared length over the limit is rejected before the handler runs.
+	resp := rawRequest(t, addr, "POST / HTTP/1.1\r\nHost: x\r\nConnection: close\r\nContent-Length: 1001\r\n\r\n"+strings.Repeat("a", 1001))
+	if !strings.HasPrefix(resp, "HTTP/1.1 413 ") {
+		t.Errorf("declared too large: response = %q, want 413", resp)
+	}
+
+	// A chunked body only turns out too large while it is copied.
+	chunk := strings.Repeat("a", 600)
+	rawRequest(t, addr, "POST / HTTP/1.1\r\nHost: x\r\nConnection: close\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"258\r\n"+chunk+"\r\n258\r\n"+chunk+"\r\n0\r\n\r\n")
+	if err := <-copyErr; !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("chunked too large: err = %v, want ErrBodyTooLarge", err)
+	}
+}
+
+func TestSlowUploadOutlastsRequestTimeout(t *testing.T) {
+	captureLog(t)
+	defer func(d, b time.Duration) { requestReadTimeout, bodyReadTimeout = d, b }(requestReadTimeout, bodyReadTimeout)
+	requestReadTimeout, bodyReadTimeout = 100*time.Millisecond, 100*time.Millisecond
+	s := NewServer("")
+	type result struct {
+		n   int64
+		err error
+	}
+	copied := make(chan result, 1)
+	s.Handle("POST", "/", func(w ResponseWriter, r *Request) {
+		n, err := r.CopyBodyTo(io.Discard)
+		copied <- result{n, err}
+	})
+	addr := startServer(t, s)
+
+	send := func(parts []string, gap time.Duration) result {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "POST / HTTP/1.1\r\nHost: x\r\nConnection: close\r\nContent-Length: 10\r\n\r\n")
+		for _, part := range parts {
+			time.Sleep(gap)
+			io.WriteString(conn, part)
+		}
+		return <-copied
+	}
+
+	// Each part arrives well within the body's timeout, but the whole upload
+	// takes longer than the headers may.
+	if res := send([]string{"aa", "aa", "aa", "aa", "aa"}, 50*time.Millisecond); res.err != nil || res.n != 10 {
+		t.Errorf("steady upload: copied %d bytes, err = %v; want 10 bytes", res.n, res.err)
+	}
+	// A client that stops sending is still cut off.
+	if res := send([]string{"aa", "aa"}, 300*time.Millisecond); res.err == nil {
+		t.Errorf("stalled upload: copied %d bytes without an error", res.n)
+	}
+}
+
+func TestLazyContinue(t *testing.T) {
+	s := NewServer("")
+	s.Handle("POST", "/upload", func(w ResponseWriter, r *Request) {
+		if r.Headers["Authorization"] == "" {
+			httpError(w, r, 401)
+			return
+		}
+		body, _ := io.ReadAll(r.BodyReader())
+		w.Write(body)
+	})
+	addr := startServer(t, s)
+
+	t.Run("rejected before reading", func(t *testing.T) {
+		// The body is never sent; the 401 has to arrive anyway, with no
+		// 100 Continue before it, and the server closes the connection
+		// since the request isn't over.
+		resp := rawRequest(t, addr, "POST /upload HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+		if !strings.HasPrefix(resp, "HTTP/1.1 401 ") {
+			t.Errorf("response = %q, want a 401 straight away", resp)
+		}
+		if strings.Contains(resp, "100 Continue") {
+			t.Errorf("response = %q, want no 100 Continue", resp)
+		}
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: x\r\nAuthorization: yes\r\nExpect: 100-continue\r\nContent-Length: 5\r\nConnection: close\r\n\r\n")
+		br := bufio.NewReader(conn)
+		line, err := br.ReadString('\n')
+		if err != nil || line != "HTTP/1.1 100 Continue\r\n" {
+			t.Fatalf("first line = %q, %v; want 100 Continue", line, err)
+		}
+		br.ReadString('\n')
+		io.WriteString(conn, "hello")
+		if res, body := readResponse(t, br); res.StatusCode != 200 || body != "hello" {
+			t.Errorf("response = %d %q, want 200 %q", res.StatusCode, body, "hello")
+		}
+	})
+}
+
+func TestNoContinueAfterResponseHeaders(t *testing.T) {
+	s := NewServer("")
+	s.Handle("POST", "/stream", func(w ResponseWriter, r *Request) {
+		w.WriteHeader(200)
+		w.Flush()
+		body, _ := io.ReadAll(r.BodyReader())
+		w.Write(body)
+	})
+	addr := startServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "POST /stream HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	br := bufio.NewReader(conn)
+	if line, err := br.ReadString('\n'); err != nil || line != "HTTP/1.1 200 OK\r\n" {
+		t.Fatalf("first line = %q, %v; want the final response", line, err)
+	}
+	// The client gives up waiting for 100 Continue and sends the body.
+	io.WriteString(conn, "hello")
+	rest, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(rest), "100 Continue") {
+		t.Errorf("response = %q, want no 100 Continue after the final headers", rest)
+	}
+	if !strings.Contains(string(rest), "hello") {
+		t.Errorf("response = %q, want the body echoed", rest)
+	}
+	// ReadAll only returns because the server closed the connection, even
+	// though the client asked for keep-alive.
+}
+
+func TestContinueDeclaredTooLarge(t *testing.T) {
+	captureLog(t)
+	s := NewServer("")
+	s.MaxBodySize = 1000
+	s.Handle("POST", "/", func(w ResponseWriter, r *Request) {
+		io.ReadAll(r.BodyReader())
+	})
+	s.Handle("POST", "/small", func(w ResponseWriter, r *Request) {
+		io.ReadAll(MaxBytesReader(w, r, 10))
+	})
+	addr := startServer(t, s)
+
+	// The body is never sent: the 413 has to come without a 100 Continue
+	// asking for it, and the server can't wait for the body to drain it.
+	for _, request := range []string{
+		"POST / HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 1001\r\n\r\n",
+		"POST /small HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 20\r\n\r\n",
+	} {
+		resp := rawRequest(t, addr, request)
+		if !strings.HasPrefix(resp, "HTTP/1.1 413 ") || strings.Contains(resp, "100 Continue") {
+			t.Errorf("%q: response = %q, want a 413 and no 100 Continue", request, resp)
+		}
+	}
+}
+
+func TestChunkedRequestTrailers(t *testing.T) {
+	s := NewServer("")
+	type result struct {
+		body     string
+		trailers map[string]string
+	}
+	results := make(chan result, 1)
+	s.Handle("POST", "/upload", func(w ResponseWriter, r *Request) {
+		body, _ := io.ReadAll(r.BodyReader())
+		results <- result{string(body), r.Trailers}
+	})
+	addr := startServer(t, s)
+
+	resp := rawRequest(t, addr, "POST /upload HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\nConnection: close\r\n\r\n"+
+		"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: sha256=abc\r\nX-Other :  spaced \r\n\r\n")
+	if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+		t.Fatalf("response = %q, want 200", resp)
+	}
+	got := <-results
+	if got.body != "hello world" {
+		t.Errorf("body = %q, want %q", got.body, "hello world")
+	}
+	if got.trailers["X-Checksum"] != "sha256=abc" || got.trailers["X-Other"] != "spaced" {
+		t.Errorf("trailers = %v", got.trailers)
+	}
+}
+
+func TestChunkedReaderLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		r    io.Reader
+	}{
+		{"endless chunk size", io.MultiReader(strings.NewReader("5\r\nhello\r\n"), endlessReader('0'))},
+		{"endless extension", io.MultiReader(strings.NewReader("5;ext="), endlessReader('x'))},
+		{"endless trailer", io.MultiReader(strings.NewReader("0\r\nX-Big: "), endlessReader('v'))},
+		{"too many trailers", strings.NewReader("0\r\n" + strings.Repeat("X-A: b\r\n", 10000) + "\r\n")},
+	}
+	for _, tt := range tests {
+		cr := &chunkedReader{r: bufio.NewReader(tt.r), trailers: make(map[string]string)}
+		if _, err := io.ReadAll(cr); err == nil || err == io.ErrUnexpectedEOF {
+			t.Errorf("%s: err = %v, want a limit error", tt.name, err)
+		}
+	}
+}
+
+func TestMaxBytesReader(t *testing.T) {
+	s := NewServer("")
+	readErr := make(chan error, 1)
+	s.Handle("POST", "/read", func(w ResponseWriter, r *Request) {
+		body, err := io.ReadAll(MaxBytesReader(w, r, 10))
+		readErr <- err
+		if err == nil {
+			w.Write(body)
+		}
+	})
+	s.Handle("POST", "/ignore", func(w ResponseWriter, r *Request) {
+		MaxBytesReader(w, r, 10)
+		w.Write([]byte("ignored"))
+	})
+	s.Handle("GET", "/next", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("next"))
+	})
+	addr := startServer(t, s)
+	next := "GET /next HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"
+	body := strings.Repeat("x", 20)
+
+	t.Run("declared too large", func(t *testing.T) {
+		// The body isn't sent: the server has to answer without it.
+		resp := rawRequest(t, addr, "POST /read HTTP/1.1\r\nHost: x\r\nContent-Length: 20\r\n\r\n")
+		if err := <-readErr; err != ErrBodyTooLarge {
+			t.Errorf("read err = %v, want ErrBodyTooLarge", err)
+		}
+		// The body isn't drained, so the connection is closed.
+		if !strings.HasPrefix(resp, "HTTP/1.1 413 ") || !strings.Contains(resp, "Connection: close") {
+			t.Errorf("response = %q, want a 413 that closes the connection", resp)
+		}
+	})
+
+	t.Run("chunked too large", func(t *testing.T) {
+		resp := rawRequest(t, addr, "POST /read HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n14\r\n"+body+"\r\n0\r\n\r\n"+next)
+		if err := <-readErr; err != ErrBodyTooLarge {
+			t.Errorf("read err = %v, want ErrBodyTooLarge", err)
+		}
+		if !strings.HasPrefix(resp, "HTTP/1.1 413 ") || !strings.Contains(resp, "Connection: close") {
+			t.Errorf("response = %q, want a 413 that closes the connection", resp)
+		}
+	})
+
+	t.Run("within limit", func(t *testing.T) {
+		resp := rawRequest(t, addr, "POST /read HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello"+next)
+		if err := <-readErr; err != nil {
+			t.Errorf("read err = %v", err)
+		}
+		br := bufio.NewReader(strings.NewReader(resp))
+		if res, got := readResponse(t, br); res.StatusCode != 200 || got != "hello" {
+			t.Errorf("response = %d %q, want 200 %q", res.StatusCode, got, "hello")
+		}
+	})
+
+	t.Run("unread body over the limit", func(t *testing.T) {
+		// The server drains what the handler left, which isn't the handler
+		// reading past its limit: no 413, and the connection stays usable.
+		resp := rawRequest(t, addr, "POST /ignore HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n14\r\n"+body+"\r\n0\r\n\r\n"+next)
+		br := bufio.NewReader(strings.NewReader(resp))
+		if res, got := readResponse(t, br); res.StatusCode != 200 || got != "ignored" {
+			t.Errorf("response = %d %q, want 200 %q", res.StatusCode, got, "ignored")
+		}
+		if _, got := readResponse(t, br); got != "next" {
+			t.Errorf("next response = %q, want %q", got, "next")
+		}
+	})
+
+	t.Run("unread body declared too large", func(t *testing.T) {
+		resp := rawRequest(t, addr, "POST /ignore HTTP/1.1\r\nHost: x\r\nContent-Length: 20\r\n\r\n")
+		if !strings.HasPrefix(resp, "HTTP/1.1 200 ") || strings.Contains(resp, "413") {
+			t.Errorf("response = %q, want a 200 and then the connection closed", resp)
+		}
+	})
+}
+
+func TestIgnoredBodyIsDrained(t *testing.T) {
+	s := NewServer("")
+	s.Handle("POST", "/ignore", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("ignored"))
+	})
+	s.Handle("POST", "/partial", func(w ResponseWriter, r *Request) {
+		io.ReadFull(r.BodyReader(), make([]byte, 3))
+		w.Write([]byte("partial"))
+	})
+	s.Handle("GET", "/next", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("next"))
+	})
+	addr := startServer(t, s)
+	next := "GET /next HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"
+	body := strings.Repeat("b", 10000)
+
+	tests := []struct {
+		name, request, first string
+	}{
+		{"ignored", "POST /ignore HTTP/1.1\r\nHost: x\r\nContent-Length: 10000\r\n\r\n" + body, "ignored"},
+		{"partly read", "POST /partial HTTP/1.1\r\nHost: x\r\nContent-Length: 10000\r\n\r\n" + body, "partial"},
+		{"chunked", "POST /ignore HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n2710\r\n" + body + "\r\n0\r\n\r\n", "ignored"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(rawRequest(t, addr, tt.request+next)))
+			if _, got := readResponse(t, br); got != tt.first {
+				t.Errorf("first response = %q, want %q", got, tt.first)
+			}
+			if _, got := readResponse(t, br); got != "next" {
+				t.Errorf("pipelined response = %q, want %q", got, "next")
+			}
+		})
+	}
+}
+
+func TestRewindableBodyMiddleware(t *testing.T) {
+	s := NewServer("")
+	s.Use(RewindableBodyMiddleware(16))
+	seen := make(chan string, 1)
+	s.Use(func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			// Stands in for signature verification, which reads it all.
+			data, _ := io.ReadAll(r.BodyReader())
+			seen <- string(data)
+			next(w, r)
+		}
+	})
+	s.Handle("POST", "/echo", func(w ResponseWriter, r *Request) {
+		data, err := io.ReadAll(r.BodyReader())
+		if err != nil || string(data) != r.Body() {
+			t.Errorf("BodyReader = %q, %v; Body = %q", data, err, r.Body())
+		}
+		w.Write(data)
+	})
+	addr := startServer(t, s)
+
+	for _, request := range []string{
+		"POST /echo HTTP/1.1\r\nHost: x\r\nContent-Length: 11\r\nConnection: close\r\n\r\nhello world",
+		"POST /echo HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n6\r\nhello \r\n5\r\nworld\r\n0\r\n\r\n",
+	} {
+		resp := rawRequest(t, addr, request)
+		if got := <-seen; got != "hello world" {
+			t.Errorf("middleware read %q", got)
+		}
+		if !strings.HasPrefix(resp, "HTTP/1.1 200 ") || !strings.HasSuffix(resp, "\r\n\r\nhello world") {
+			t.Errorf("response = %q, want the body echoed", resp)
+		}
+	}
+
+	resp := rawRequest(t, addr, "POST /echo HTTP/1.1\r\nHost: x\r\nContent-Length: 20\r\n\r\n"+strings.Repeat("x", 20))
+	if !strings.HasPrefix(resp, "HTTP/1.1 413 ") || !strings.Contains(resp, "Connection: close") {
+		t.Errorf("response = %q, want a 413 that closes the connection", resp)
+	}
+	select {
+	case got := <-seen:
+		t.Errorf("a body over the limit reached the next middleware: %q", got)
+	default:
+	}
+}
@@ -0,0 +1,42 @@
+// checksum.go
+// This file contains a writer for integrity-checked downloads: the body is
+// streamed as usual, and its SHA-256 follows in a trailer, so a client can
+// verify what it got without the server buffering the body to hash it first.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
+// ChecksumTrailer is the trailer field ChecksumWriter sends the body's
+// SHA-256 in, as lowercase hex.
+const ChecksumTrailer = "X-Checksum-SHA256"
+
+// ChecksumWriter writes a response body and hashes it on the way.
+type ChecksumWriter struct {
+	w ResponseWriter
+	h hash.Hash
+}
+
+// NewChecksumWriter announces the checksum trailer on w, so it must be
+// called before anything is written to w.
+func NewChecksumWriter(w ResponseWriter) *ChecksumWriter {
+	w.SetHeader("Trailer", ChecksumTrailer)
+	return &ChecksumWriter{w: w, h: sha256.New()}
+}
+
+func (cw *ChecksumWriter) Write(data []byte) (int, error) {
+	n, err := cw.w.Write(data)
+	cw.h.Write(data[:n])
+	return n, err
+}
+
+// Close sets the trailer to the checksum of everything written. It goes out
+// after the last chunk, once the handler returns.
+func (cw *ChecksumWriter) Close() error {
+	cw.w.SetTrailer(ChecksumTrailer, hex.EncodeToString(cw.h.Sum(nil)))
+	return nil
+}
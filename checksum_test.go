@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChecksumWriter(t *testing.T) {
+	content := strings.Repeat("integrity-checked download\n", 1000)
+	s := NewServer("")
+	s.Handle("GET", "/download", func(w ResponseWriter, r *Request) {
+		cw := NewChecksumWriter(w)
+		defer cw.Close()
+		// Stream in pieces, as from a file.
+		io.CopyBuffer(cw, strings.NewReader(content), make([]byte, 1000))
+	})
+	addr := startServer(t, s)
+	sum := sha256.Sum256([]byte(content))
+	want := hex.EncodeToString(sum[:])
+
+	resp := rawRequest(t, addr, "GET /download HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	res, body := readResponse(t, bufio.NewReader(strings.NewReader(resp)))
+	if body != content {
+		t.Fatalf("body is %d bytes, want %d", len(body), len(content))
+	}
+	if len(res.TransferEncoding) == 0 {
+		t.Errorf("Transfer-Encoding = %q, want chunked", res.TransferEncoding)
+	}
+	if got := res.Trailer.Get(ChecksumTrailer); got != want {
+		t.Errorf("trailer %s = %q, want %q", ChecksumTrailer, got, want)
+	}
+
+	// An HTTP/1.0 client can't take trailers, but still gets the body.
+	resp = rawRequest(t, addr, "GET /download HTTP/1.0\r\n\r\n")
+	if _, body := readResponse(t, bufio.NewReader(strings.NewReader(resp))); body != content {
+		t.Errorf("HTTP/1.0 body is %d bytes, want %d", len(body), len(content))
+	}
+}
@@ -0,0 +1,156 @@
+// circuitbreaker.go
+// This file contains a per-route circuit breaker. When too many requests to
+// a route fail or blow their latency budget, the route is short-circuited
+// with 503 for a cooldown period instead of piling more load on whatever is
+// failing. After the cooldown a single trial request decides whether the
+// route recovers.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// CircuitBreakerConfig controls when a route's circuit opens.
+type CircuitBreakerConfig struct {
+	// LatencyBudget counts responses slower than this as failures. Zero
+	// means only 5xx responses count.
+	LatencyBudget time.Duration
+	// FailureRate is the fraction of failed requests (0-1) that opens the circuit.
+	FailureRate float64
+	// MinRequests is how many requests a window needs before FailureRate applies.
+	MinRequests int
+	// Window is how long failures are counted before the tally starts over.
+	// Zero keeps counting until the circuit opens.
+	Window time.Duration
+	// Cooldown is how long an open circuit rejects requests before trying one again.
+	Cooldown time.Duration
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+type circuit struct {
+	state       circuitState
+	windowStart time.Time
+	total       int
+	failures    int
+	openedAt    time.Time
+	lastUsed    time.Time
+}
+
+// unmatchedCircuit is the key of the one circuit shared by all requests that
+// matched no route, whatever their method or path.
+const unmatchedCircuit = "unmatched"
+
+// CircuitBreakerMiddleware tracks failures per route (method and route
+// pattern, see Request.RoutePattern) and answers 503 with Retry-After while
+// a route's circuit is open.
+func CircuitBreakerMiddleware(config CircuitBreakerConfig) Middleware {
+	var mu sync.Mutex
+	circuits := make(map[string]*circuit)
+	lastSweep := time.Now()
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			key := unmatchedCircuit
+			if r.RoutePattern() != "" {
+				key = r.Method + " " + r.RoutePattern()
+			}
+			now := time.Now()
+
+			mu.Lock()
+			// Closed circuits of routes that haven't been used for a while
+			// are dropped now and then to keep the map small.
+			if now.Sub(lastSweep) > time.Minute {
+				idle := max(config.Window, time.Minute)
+				for k, c := range circuits {
+					if c.state == circuitClosed && now.Sub(c.lastUsed) > idle {
+						delete(circuits, k)
+					}
+				}
+				lastSweep = now
+			}
+			c, ok := circuits[key]
+			if !ok {
+				c = &circuit{windowStart: now}
+				circuits[key] = c
+			}
+			c.lastUsed = now
+			allowed := c.allow(now, config)
+			retryAfter := c.openedAt.Add(config.Cooldown).Sub(now)
+			mu.Unlock()
+
+			if !allowed {
+				w.SetHeader("Retry-After", fmt.Sprint(int(math.Ceil(max(retryAfter, time.Second).Seconds()))))
+				httpError(w, r, 503)
+				return
+			}
+
+			// A handler that panics counts as a failure too; a half-open
+			// circuit would otherwise wait for its trial request forever.
+			failed := true
+			defer func() {
+				mu.Lock()
+				c.record(failed, time.Now(), config)
+				mu.Unlock()
+			}()
+			duration, _ := timeHandler(next, w, r)
+			failed = w.Status() >= 500 || (config.LatencyBudget > 0 && duration > config.LatencyBudget)
+		}
+	}
+}
+
+// allow reports whether a request may go through, moving an open circuit to
+// half-open once its cooldown is over. Only one trial request is let through
+// while half-open.
+func (c *circuit) allow(now time.Time, config CircuitBreakerConfig) bool {
+	switch c.state {
+	case circuitOpen:
+		if now.Sub(c.openedAt) < config.Cooldown {
+			return false
+		}
+		c.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		return false
+	}
+	return true
+}
+
+func (c *circuit) record(failed bool, now time.Time, config CircuitBreakerConfig) {
+	if c.state == circuitHalfOpen {
+		if failed {
+			c.state, c.openedAt = circuitOpen, now
+		} else {
+			c.reset(now)
+		}
+		return
+	}
+	// A request that started before the circuit opened doesn't count.
+	if c.state == circuitOpen {
+		return
+	}
+	if config.Window > 0 && now.Sub(c.windowStart) > config.Window {
+		c.reset(now)
+	}
+	c.total++
+	if failed {
+		c.failures++
+	}
+	if c.total >= config.MinRequests && float64(c.failures)/float64(c.total) >= config.FailureRate {
+		c.state, c.openedAt = circuitOpen, now
+	}
+}
+
+func (c *circuit) reset(now time.Time) {
+	*c = circuit{state: circuitClosed, windowStart: now, lastUsed: c.lastUsed}
+}
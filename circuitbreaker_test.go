@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerMiddleware(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	h := CircuitBreakerMiddleware(CircuitBreakerConfig{
+		FailureRate: 0.5,
+		MinRequests: 4,
+		Cooldown:    50 * time.Millisecond,
+	})(func(w ResponseWriter, r *Request) {
+		if failing.Load() {
+			w.WriteHeader(500)
+		}
+	})
+	get := func(pattern, path string) *StoredResponse {
+		r := newTestRequest("GET", path, nil, "")
+		r.routePattern = pattern
+		return serveRecorded(h, r)
+	}
+
+	for i := 0; i < 4; i++ {
+		if res := get("/users/:id", "/users/1"); res.Status != 500 {
+			t.Fatalf("request %d: status = %d, want 500 from the handler", i, res.Status)
+		}
+	}
+	// The circuit is per route pattern, not per path.
+	res := get("/users/:id", "/users/2")
+	if res.Status != 503 || res.Headers["Retry-After"] != "1" {
+		t.Fatalf("open circuit: status = %d, Retry-After = %q; want 503, 1", res.Status, res.Headers["Retry-After"])
+	}
+	if res := get("/orders", "/orders"); res.Status != 500 {
+		t.Errorf("other route: status = %d, want it to reach the handler", res.Status)
+	}
+
+	// A failed trial after the cooldown opens the circuit again.
+	time.Sleep(60 * time.Millisecond)
+	if res := get("/users/:id", "/users/3"); res.Status != 500 {
+		t.Fatalf("half-open trial: status = %d, want 500 from the handler", res.Status)
+	}
+	if res := get("/users/:id", "/users/3"); res.Status != 503 {
+		t.Fatalf("after failed trial: status = %d, want 503", res.Status)
+	}
+
+	// A successful trial closes it.
+	failing.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if res := get("/users/:id", "/users/4"); res.Status != 200 {
+			t.Fatalf("recovered request %d: status = %d, want 200", i, res.Status)
+		}
+	}
+}
+
+func TestCircuitBreakerHalfOpenSingleTrial(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	h := CircuitBreakerMiddleware(CircuitBreakerConfig{
+		FailureRate: 1,
+		MinRequests: 1,
+		Cooldown:    10 * time.Millisecond,
+	})(func(w ResponseWriter, r *Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		<-release
+	})
+	get := func() *StoredResponse {
+		r := newTestRequest("GET", "/slow", nil, "")
+		r.routePattern = "/slow"
+		return serveRecorded(h, r)
+	}
+
+	get()
+	time.Sleep(20 * time.Millisecond)
+	trial := make(chan *StoredResponse)
+	go func() { trial <- get() }()
+	for calls.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if res := get(); res.Status != 503 {
+		t.Errorf("request during trial: status = %d, want 503", res.Status)
+	}
+	close(release)
+	if res := <-trial; res.Status != 200 {
+		t.Errorf("trial: status = %d, want 200", res.Status)
+	}
+}
+
+func TestCircuitBreakerHalfOpenTrialPanics(t *testing.T) {
+	var calls atomic.Int32
+	h := CircuitBreakerMiddleware(CircuitBreakerConfig{
+		FailureRate: 1,
+		MinRequests: 1,
+		Cooldown:    10 * time.Millisecond,
+	})(func(w ResponseWriter, r *Request) {
+		switch calls.Add(1) {
+		case 1:
+			w.WriteHeader(500)
+		case 2:
+			panic("trial failed")
+		}
+	})
+	get := func() (res *StoredResponse, panicked bool) {
+		defer func() {
+			if recover() != nil {
+				panicked = true
+			}
+		}()
+		r := newTestRequest("GET", "/flaky", nil, "")
+		r.routePattern = "/flaky"
+		return serveRecorded(h, r), false
+	}
+
+	get()
+	time.Sleep(20 * time.Millisecond)
+	if _, panicked := get(); !panicked {
+		t.Fatal("the trial's panic didn't reach the caller")
+	}
+	// The panic reopened the circuit, so after another cooldown there is a
+	// new trial instead of 503s forever.
+	if res, _ := get(); res.Status != 503 {
+		t.Errorf("right after the failed trial: status = %d, want 503", res.Status)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if res, _ := get(); res.Status != 200 {
+		t.Errorf("after the cooldown: status = %d, want 200", res.Status)
+	}
+}
+
+func TestCircuitBreakerLatencyBudget(t *testing.T) {
+	h := CircuitBreakerMiddleware(CircuitBreakerConfig{
+		LatencyBudget: 5 * time.Millisecond,
+		FailureRate:   1,
+		MinRequests:   2,
+		Cooldown:      time.Minute,
+	})(func(w ResponseWriter, r *Request) {
+		time.Sleep(10 * time.Millisecond)
+	})
+	for i, want := range []int{200, 200, 503} {
+		r := newTestRequest("GET", "/report", nil, "")
+		r.routePattern = "/report"
+		if res := serveRecorded(h, r); res.Status != want {
+			t.Errorf("request %d: status = %d, want %d", i, res.Status, want)
+		}
+	}
+}
+
+func TestCircuitBreakerUnmatched(t *testing.T) {
+	h := CircuitBreakerMiddleware(CircuitBreakerConfig{
+		FailureRate: 1,
+		MinRequests: 2,
+		Cooldown:    time.Minute,
+	})(func(w ResponseWriter, r *Request) {
+		w.WriteHeader(500)
+	})
+	// Requests that matched no route share one circuit whatever their path
+	// or method, so scanning random URLs can't grow the map.
+	for _, target := range []string{"/a", "/b"} {
+		serveRecorded(h, newTestRequest("GET", target, nil, ""))
+	}
+	if res := serveRecorded(h, newTestRequest("POST", "/c", nil, "")); res.Status != 503 {
+		t.Errorf("unmatched request: status = %d, want 503", res.Status)
+	}
+}
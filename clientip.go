@@ -0,0 +1,141 @@
+// clientip.go
+// This file works out which client a request came from and which host it
+// asked for. Behind a reverse proxy the peer is the proxy, so both are taken
+// from the X-Forwarded-For and X-Forwarded-Host headers it adds, but only if
+// it is a proxy the server was told to trust; anything else could be forged
+// by the client.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// SetTrustedProxies sets the addresses of the reverse proxies in front of the
+// server, as CIDR ranges or single IPs. Requests arriving through them are
+// attributed to the client named in X-Forwarded-For.
+func (s *Server) SetTrustedProxies(cidrs []string) error {
+	prefixes, err := parsePrefixes(cidrs)
+	if err != nil {
+		return err
+	}
+	s.trustedProxies = prefixes
+	return nil
+}
+
+// parsePrefixes parses CIDR ranges, taking a single IP as a range of one.
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP %q: %v", cidr, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address of the client that sent the request, or ""
+// if it can't be told. See clientAddr.
+func (r *Request) ClientIP() string {
+	if addr := r.clientAddr(); addr.IsValid() {
+		return addr.String()
+	}
+	return ""
+}
+
+// Host returns the host the client asked for. Behind a trusted proxy that is
+// the X-Forwarded-Host the proxy set, since the Host header then names the
+// server as the proxy knows it. Otherwise it is the Host header, and a
+// client's own X-Forwarded-Host is ignored.
+func (r *Request) Host() string {
+	if r.fromTrustedProxy() {
+		hosts := strings.Split(r.Headers["X-Forwarded-Host"], ",")
+		// The last entry is the one the nearest proxy, the trusted one, added.
+		if host := strings.TrimSpace(hosts[len(hosts)-1]); host != "" {
+			return host
+		}
+	}
+	return r.Headers["Host"]
+}
+
+// peerAddr returns the address of the peer the request came from.
+func (r *Request) peerAddr() netip.Addr {
+	if r.Conn == nil {
+		return netip.Addr{}
+	}
+	host, _, err := net.SplitHostPort(r.Conn.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// fromTrustedProxy reports whether the peer is one of the trusted proxies.
+func (r *Request) fromTrustedProxy() bool {
+	return r.server != nil && prefixesContain(r.server.trustedProxies, r.peerAddr())
+}
+
+// clientAddr returns the peer's address unless the peer is a trusted proxy.
+// Then X-Forwarded-For is walked from its end, where each proxy appended the
+// address it got the request from, to the first hop that isn't trusted.
+func (r *Request) clientAddr() netip.Addr {
+	addr := r.peerAddr()
+	if r.server == nil {
+		return addr
+	}
+	hops := strings.Split(r.Headers["X-Forwarded-For"], ",")
+	for i := len(hops) - 1; i >= 0 && prefixesContain(r.server.trustedProxies, addr); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+	}
+	return addr
+}
+
+// IPAllowlistMiddleware answers 403 to clients whose IP (see
+// Request.ClientIP) isn't in any of the given CIDR ranges, e.g. to keep admin
+// routes internal. IPv4 and IPv6 ranges can be mixed, and a single IP counts
+// as a range of one. It panics if a range doesn't parse.
+func IPAllowlistMiddleware(cidrs []string) Middleware {
+	allowed, err := parsePrefixes(cidrs)
+	if err != nil {
+		panic("IPAllowlistMiddleware: " + err.Error())
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			if addr := r.clientAddr(); !addr.IsValid() || !prefixesContain(allowed, addr) {
+				httpError(w, r, 403)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// peerConn is a connection that only knows its peer's address.
+type peerConn struct {
+	net.Conn
+	addr string
+}
+
+func (c peerConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+// requestFrom returns a request that arrived at s from peer.
+func requestFrom(s *Server, peer string, headers map[string]string) *Request {
+	r := newTestRequest("GET", "/admin", headers, "")
+	r.Conn = peerConn{addr: peer}
+	r.server = s
+	return r
+}
+
+func TestIPAllowlistMiddleware(t *testing.T) {
+	s := NewServer("")
+	if err := s.SetTrustedProxies([]string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	h := IPAllowlistMiddleware([]string{"192.168.1.0/24", "2001:db8::/32", "203.0.113.7"})(func(w ResponseWriter, r *Request) {
+		w.Write([]byte("admin"))
+	})
+
+	tests := []struct {
+		name   string
+		peer   string
+		xff    string
+		status int
+	}{
+		{"IPv4 in range", "192.168.1.20:5000", "", 200},
+		{"IPv4 outside", "192.168.2.20:5000", "", 403},
+		{"single IP", "203.0.113.7:5000", "", 200},
+		{"IPv6 in range", "[2001:db8::1]:5000", "", 200},
+		{"IPv6 outside", "[2001:db9::1]:5000", "", 403},
+		{"IPv4-mapped IPv6", "[::ffff:192.168.1.20]:5000", "", 200},
+		{"via trusted proxy", "10.0.0.1:5000", "192.168.1.20", 200},
+		{"via trusted proxy, outside", "10.0.0.1:5000", "8.8.8.8", 403},
+		{"forged header", "8.8.8.8:5000", "192.168.1.20", 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.xff != "" {
+				headers["X-Forwarded-For"] = tt.xff
+			}
+			if res := serveRecorded(h, requestFrom(s, tt.peer, headers)); res.Status != tt.status {
+				t.Errorf("status = %d, want %d", res.Status, tt.status)
+			}
+		})
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("an invalid range didn't panic")
+		}
+	}()
+	IPAllowlistMiddleware([]string{"10.0.0.0/33"})
+}
+
+func TestRequestHost(t *testing.T) {
+	s := NewServer("")
+	if err := s.SetTrustedProxies([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		peer    string
+		headers map[string]string
+		want    string
+	}{
+		{"direct", "203.0.113.5:4000", map[string]string{"Host": "example.com"}, "example.com"},
+		{"trusted proxy", "10.0.0.2:4000", map[string]string{"Host": "backend:8080", "X-Forwarded-Host": "example.com"}, "example.com"},
+		{"proxy chain", "10.0.0.2:4000", map[string]string{"Host": "backend:8080", "X-Forwarded-Host": "evil.test, example.com"}, "example.com"},
+		{"trusted proxy without header", "10.0.0.2:4000", map[string]string{"Host": "backend:8080"}, "backend:8080"},
+		{"untrusted client", "203.0.113.5:4000", map[string]string{"Host": "example.com", "X-Forwarded-Host": "evil.test"}, "example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestFrom(s, tt.peer, tt.headers).Host(); got != tt.want {
+				t.Errorf("Host() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The HTTPS redirect goes to the public host.
+	h := HTTPSRedirectMiddleware(func(w ResponseWriter, r *Request) {})
+	r := requestFrom(s, "10.0.0.2:4000", map[string]string{"Host": "backend:8080", "X-Forwarded-Host": "example.com"})
+	if res := serveRecorded(h, r); res.Headers["Location"] != "https://example.com/admin" {
+		t.Errorf("redirect Location = %q, want the forwarded host", res.Headers["Location"])
+	}
+}
@@ -0,0 +1,94 @@
+// cookie.go
+// This file contains cookie support: reading the cookies a client sent and
+// building Set-Cookie headers, with a helper for session cookies that are
+// safe by default.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SameSite values for Cookie.SameSite.
+const (
+	SameSiteLax    = "Lax"
+	SameSiteStrict = "Strict"
+	SameSiteNone   = "None"
+)
+
+// Cookie is a cookie to be sent in a Set-Cookie header. Empty or zero fields
+// are left out.
+type Cookie struct {
+	Name     string
+	Value    string
+	Path     string
+	Domain   string
+	Expires  time.Time
+	MaxAge   int // Seconds; negative deletes the cookie right away.
+	Secure   bool
+	HttpOnly bool
+	SameSite string
+}
+
+// NewSessionCookie returns a cookie with safe defaults for session data: it
+// is sent for the whole site, only over HTTPS, not visible to scripts, and
+// not sent along with cross-site subrequests.
+func NewSessionCookie(name, value string) *Cookie {
+	return &Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: SameSiteLax,
+	}
+}
+
+// String serializes the cookie as a Set-Cookie header value.
+func (c *Cookie) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s=%s", c.Name, c.Value)
+	if c.Path != "" {
+		fmt.Fprintf(&sb, "; Path=%s", c.Path)
+	}
+	if c.Domain != "" {
+		fmt.Fprintf(&sb, "; Domain=%s", c.Domain)
+	}
+	if !c.Expires.IsZero() {
+		fmt.Fprintf(&sb, "; Expires=%s", c.Expires.UTC().Format(TimeFormat))
+	}
+	if c.MaxAge > 0 {
+		fmt.Fprintf(&sb, "; Max-Age=%d", c.MaxAge)
+	} else if c.MaxAge < 0 {
+		sb.WriteString("; Max-Age=0")
+	}
+	if c.HttpOnly {
+		sb.WriteString("; HttpOnly")
+	}
+	if c.Secure {
+		sb.WriteString("; Secure")
+	}
+	if c.SameSite != "" {
+		fmt.Fprintf(&sb, "; SameSite=%s", c.SameSite)
+	}
+	return sb.String()
+}
+
+// SetCookie adds a Set-Cookie header to the response, alongside any cookies
+// already set.
+func SetCookie(w ResponseWriter, c *Cookie) {
+	w.AddHeader("Set-Cookie", c.String())
+}
+
+// Cookie returns the value of the named cookie sent by the client.
+func (r *Request) Cookie(name string) (string, bool) {
+	for _, pair := range strings.Split(r.Headers["Cookie"], ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && key == name {
+			return strings.Trim(value, `"`), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewSessionCookie(t *testing.T) {
+	c := NewSessionCookie("session", "abc123")
+	if got, want := c.String(), "session=abc123; Path=/; HttpOnly; Secure; SameSite=Lax"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	// The defaults can be adjusted before sending.
+	c.MaxAge = 3600
+	c.SameSite = SameSiteStrict
+	rec := newResponseRecorder()
+	SetCookie(rec, c)
+	got := rec.result().Headers["Set-Cookie"]
+	for _, attr := range []string{"Max-Age=3600", "Secure", "HttpOnly", "SameSite=Strict"} {
+		if !strings.Contains(got, "; "+attr) {
+			t.Errorf("Set-Cookie %q lacks %s", got, attr)
+		}
+	}
+
+	// A second cookie is added rather than replacing the first.
+	SetCookie(rec, NewSessionCookie("csrf", "xyz"))
+	if more := rec.result().MoreHeaders["Set-Cookie"]; len(more) != 1 || !strings.HasPrefix(more[0], "csrf=xyz;") {
+		t.Errorf("second Set-Cookie = %q", more)
+	}
+}
@@ -0,0 +1,532 @@
+// h2c.go
+// This file contains a minimal HTTP/2 over cleartext (h2c) implementation.
+// With Server.EnableH2C set, a connection switches to HTTP/2 when it opens
+// with the HTTP/2 connection preface ("prior knowledge") or when an HTTP/1.1
+// request asks to upgrade with "Upgrade: h2c". A single request is served per connection: its
+// response is recorded, sent once the handler returns, and the connection is
+// then closed with a GOAWAY.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Frame types and flags from RFC 9113 section 6.
+const (
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	framePriority     = 0x2
+	frameRSTStream    = 0x3
+	frameSettings     = 0x4
+	framePing         = 0x6
+	frameGoAway       = 0x7
+	frameWindowUpdate = 0x8
+	frameContinuation = 0x9
+
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+const (
+	settingMaxConcurrentStreams = 0x3
+	settingInitialWindowSize    = 0x4
+	settingMaxFrameSize         = 0x5
+
+	errCodeProtocol      = 0x1
+	errCodeFlowControl   = 0x3
+	errCodeRefusedStream = 0x7
+
+	// h2MaxFrameSize is the largest frame we accept, the protocol default.
+	// It is also the smallest frame size a peer may ask for.
+	h2MaxFrameSize = 16384
+	// h2FrameSizeLimit is the largest frame size a peer may ask for.
+	h2FrameSizeLimit = 1<<24 - 1
+	// h2MaxWindow is the largest flow-control window allowed.
+	h2MaxWindow = 1<<31 - 1
+	// h2MaxHeaderBlock caps a request's header block across CONTINUATION frames.
+	h2MaxHeaderBlock = 64 << 10
+)
+
+var errStreamReset = errors.New("h2c: stream reset by client")
+
+// isH2CPreface reports whether req is the start of the HTTP/2 connection
+// preface, which parseRequest reads as the request line "PRI * HTTP/2.0".
+func isH2CPreface(req *Request) bool {
+	return req.Method == "PRI" && req.Path == "*" && req.Version == "HTTP/2.0"
+}
+
+// isH2CUpgrade reports whether req asks to switch the connection to h2c.
+func isH2CUpgrade(req *Request) bool {
+	return strings.EqualFold(req.Headers["Upgrade"], "h2c") &&
+		req.Headers["Http2-Settings"] != "" &&
+		headerHasToken(req.Headers["Connection"], "upgrade")
+}
+
+// headerHasToken reports whether a comma-separated header value contains token.
+func headerHasToken(value, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+type h2Frame struct {
+	typ     byte
+	flags   byte
+	stream  uint32
+	payload []byte
+}
+
+// h2Conn holds the state of one HTTP/2 connection.
+type h2Conn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	dec     *hpackDecoder
+	maxBody int64
+
+	// Flow control and frame size limits for what we send, set by the client.
+	maxFrameSize  int
+	connWindow    int64
+	streamWindow  int64
+	initialWindow int64
+}
+
+// serveH2C takes over a connection whose first request is either the HTTP/2
+// preface or an h2c upgrade request, and serves one request over HTTP/2.
+func (s *Server) serveH2C(conn net.Conn, reader *bufio.Reader, req *Request) {
+	hc := &h2Conn{
+		conn:          conn,
+		r:             reader,
+		dec:           newHpackDecoder(),
+		maxBody:       s.MaxBodySize,
+		maxFrameSize:  h2MaxFrameSize,
+		connWindow:    65535,
+		streamWindow:  65535,
+		initialWindow: 65535,
+	}
+	if err := hc.start(req); err != nil {
+		log.Printf("Error starting h2c connection: %v", err)
+		return
+	}
+
+	streamID := uint32(1)
+	if isH2CPreface(req) {
+		var err error
+		if req, streamID, err = hc.readRequest(); err != nil {
+			log.Printf("Error reading h2c request: %v", err)
+			return
+		}
+		req.server = s
+	}
+
+	rec := newResponseRecorder()
+	s.serveRequest(rec, req)
+	result := rec.result()
+	if _, ok := result.Headers["Content-Type"]; !ok && s.DefaultContentType != "" {
+		result.Headers["Content-Type"] = s.DefaultContentType
+	}
+	if err := hc.writeResponse(streamID, result); err != nil {
+		log.Printf("Error writing h2c response: %v", err)
+		return
+	}
+	// NO_ERROR, and no streams beyond this one were processed.
+	payload := binary.BigEndian.AppendUint32(nil, streamID)
+	hc.writeFrame(frameGoAway, 0, 0, binary.BigEndian.AppendUint32(payload, 0))
+}
+
+// start completes the switch to HTTP/2: it answers an upgrade request with
+// 101, sends our SETTINGS, reads the rest of the client preface, and for an
+// upgrade waits for the client's SETTINGS.
+func (hc *h2Conn) start(req *Request) error {
+	preface := h2Preface
+	if isH2CPreface(req) {
+		// parseRequest already consumed "PRI * HTTP/2.0\r\n\r\n".
+		preface = preface[len(preface)-len("SM\r\n\r\n"):]
+	} else {
+		// The upgrade request becomes stream 1. Its body has to be read now,
+		// while the connection still speaks HTTP/1.1.
+		req.Body()
+		delete(req.Headers, "Upgrade")
+		delete(req.Headers, "Http2-Settings")
+		delete(req.Headers, "Connection")
+		if _, err := io.WriteString(hc.conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"); err != nil {
+			return err
+		}
+	}
+
+	var settings []byte
+	settings = binary.BigEndian.AppendUint16(settings, settingMaxConcurrentStreams)
+	settings = binary.BigEndian.AppendUint32(settings, 1)
+	if err := hc.writeFrame(frameSettings, 0, 0, settings); err != nil {
+		return err
+	}
+
+	got := make([]byte, len(preface))
+	if _, err := io.ReadFull(hc.r, got); err != nil {
+		return err
+	}
+	if string(got) != preface {
+		return fmt.Errorf("invalid connection preface")
+	}
+	if isH2CPreface(req) {
+		return nil
+	}
+	for {
+		f, err := hc.readFrame()
+		if err != nil {
+			return err
+		}
+		if _, err := hc.handleControl(f, 1); err != nil {
+			return err
+		}
+		if f.typ == frameSettings && f.flags&flagAck == 0 {
+			return nil
+		}
+	}
+}
+
+// readRequest reads frames until the first stream has sent a complete request.
+func (hc *h2Conn) readRequest() (*Request, uint32, error) {
+	var (
+		req      *Request
+		streamID uint32
+		block    []byte
+		body     bytes.Buffer
+		ended    bool
+	)
+	for {
+		f, err := hc.readFrame()
+		if err != nil {
+			return nil, 0, err
+		}
+		if handled, err := hc.handleControl(f, streamID); err != nil {
+			return nil, 0, err
+		} else if handled {
+			continue
+		}
+		if streamID != 0 && f.stream != streamID && (f.typ == frameHeaders || f.typ == frameData) {
+			// Only one stream is served; refuse the rest.
+			payload := binary.BigEndian.AppendUint32(nil, errCodeRefusedStream)
+			if err := hc.writeFrame(frameRSTStream, 0, f.stream, payload); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		switch f.typ {
+		case frameHeaders, frameContinuation:
+			payload := f.payload
+			if f.typ == frameHeaders {
+				if streamID == 0 {
+					streamID = f.stream
+				}
+				if payload, err = stripHeadersPadding(f); err != nil {
+					return nil, 0, err
+				}
+			}
+			block = append(block, payload...)
+			if len(block) > h2MaxHeaderBlock {
+				return nil, 0, fmt.Errorf("header block too large")
+			}
+			if f.flags&flagEndHeaders == 0 {
+				continue
+			}
+			fields, err := hc.dec.decode(block)
+			if err != nil {
+				return nil, 0, err
+			}
+			block = nil
+			// A second header block on the stream holds trailers, which are dropped.
+			if req == nil {
+				if req, err = h2Request(hc.conn, fields); err != nil {
+					return nil, 0, err
+				}
+			}
+		case frameData:
+			if req == nil {
+				return nil, 0, fmt.Errorf("DATA before HEADERS")
+			}
+			data := f.payload
+			if f.flags&flagPadded != 0 {
+				if len(data) == 0 || int(data[0]) >= len(data) {
+					return nil, 0, fmt.Errorf("invalid padding")
+				}
+				data = data[1 : len(data)-int(data[0])]
+			}
+			body.Write(data)
+			if hc.maxBody > 0 && int64(body.Len()) > hc.maxBody {
+				return nil, 0, ErrBodyTooLarge
+			}
+			// Hand the flow-control credit straight back to the client.
+			if n := len(f.payload); n > 0 {
+				inc := binary.BigEndian.AppendUint32(nil, uint32(n))
+				hc.writeFrame(frameWindowUpdate, 0, 0, inc)
+				if f.flags&flagEndStream == 0 {
+					hc.writeFrame(frameWindowUpdate, 0, streamID, inc)
+				}
+			}
+		case frameRSTStream:
+			if f.stream == streamID {
+				return nil, 0, errStreamReset
+			}
+		}
+
+		if (f.typ == frameHeaders || f.typ == frameData) && f.flags&flagEndStream != 0 {
+			ended = true
+		}
+		if req != nil && ended && block == nil {
+			req.body = bytes.NewReader(body.Bytes())
+			return req, streamID, nil
+		}
+	}
+}
+
+// h2Request builds a Request from a decoded header block.
+func h2Request(conn net.Conn, fields []hpackField) (*Request, error) {
+	req := &Request{Version: "HTTP/2.0", Headers: make(map[string]string), Conn: conn}
+	var target string
+	for _, f := range fields {
+		switch f.name {
+		case ":method":
+			req.Method = f.value
+		case ":path":
+			target = f.value
+		case ":authority":
+			req.Headers["Host"] = f.value
+		case ":scheme":
+		default:
+			if strings.HasPrefix(f.name, ":") {
+				return nil, fmt.Errorf("unknown pseudo-header %q", f.name)
+			}
+			// Handlers look headers up by their usual HTTP/1.1 spelling.
+			key := textproto.CanonicalMIMEHeaderKey(f.name)
+			if prev, ok := req.Headers[key]; ok {
+				sep := ", "
+				if key == "Cookie" {
+					sep = "; "
+				}
+				f.value = prev + sep + f.value
+			}
+			req.Headers[key] = f.value
+		}
+	}
+	if req.Method == "" || target == "" {
+		return nil, fmt.Errorf("missing :method or :path")
+	}
+	req.setTarget(target)
+	return req, nil
+}
+
+// stripHeadersPadding returns the header block fragment of a HEADERS frame.
+func stripHeadersPadding(f h2Frame) ([]byte, error) {
+	payload := f.payload
+	pad := 0
+	if f.flags&flagPadded != 0 {
+		if len(payload) == 0 {
+			return nil, fmt.Errorf("invalid padding")
+		}
+		pad = int(payload[0])
+		payload = payload[1:]
+	}
+	if f.flags&flagPriority != 0 {
+		if len(payload) < 5 {
+			return nil, fmt.Errorf("invalid priority")
+		}
+		payload = payload[5:]
+	}
+	if pad > len(payload) {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return payload[:len(payload)-pad], nil
+}
+
+// handleControl deals with connection-level frames. It reports whether the
+// frame was consumed. streamID is the stream being served, if known yet.
+func (hc *h2Conn) handleControl(f h2Frame, streamID uint32) (bool, error) {
+	switch f.typ {
+	case frameSettings:
+		if f.flags&flagAck != 0 {
+			return true, nil
+		}
+		if len(f.payload)%6 != 0 {
+			return true, fmt.Errorf("malformed SETTINGS frame")
+		}
+		for p := f.payload; len(p) > 0; p = p[6:] {
+			id, val := binary.BigEndian.Uint16(p), binary.BigEndian.Uint32(p[2:])
+			switch id {
+			case settingInitialWindowSize:
+				if val > h2MaxWindow {
+					return true, hc.goAway(streamID, errCodeFlowControl, "initial window size %d too large", val)
+				}
+				hc.streamWindow += int64(val) - hc.initialWindow
+				hc.initialWindow = int64(val)
+			case settingMaxFrameSize:
+				// Below the minimum, a small enough value would keep the
+				// response from ever getting out.
+				if val < h2MaxFrameSize || val > h2FrameSizeLimit {
+					return true, hc.goAway(streamID, errCodeProtocol, "invalid max frame size %d", val)
+				}
+				hc.maxFrameSize = int(val)
+			}
+		}
+		return true, hc.writeFrame(frameSettings, flagAck, 0, nil)
+	case framePing:
+		if f.flags&flagAck != 0 {
+			return true, nil
+		}
+		return true, hc.writeFrame(framePing, flagAck, 0, f.payload)
+	case frameWindowUpdate:
+		if len(f.payload) != 4 {
+			return true, fmt.Errorf("malformed WINDOW_UPDATE frame")
+		}
+		inc := int64(binary.BigEndian.Uint32(f.payload) & 0x7fffffff)
+		if f.stream == 0 {
+			hc.connWindow += inc
+		} else if f.stream == streamID {
+			hc.streamWindow += inc
+		}
+		return true, nil
+	case framePriority:
+		return true, nil
+	case frameGoAway:
+		return true, fmt.Errorf("connection closed by client")
+	}
+	return false, nil
+}
+
+// goAway closes the connection with an error: it sends a GOAWAY with code,
+// naming streamID as the last stream processed, and returns the error
+// described by format and args.
+func (hc *h2Conn) goAway(streamID uint32, code uint32, format string, args ...any) error {
+	payload := binary.BigEndian.AppendUint32(nil, streamID)
+	hc.writeFrame(frameGoAway, 0, 0, binary.BigEndian.AppendUint32(payload, code))
+	return fmt.Errorf(format, args...)
+}
+
+// writeResponse sends a recorded response on the given stream, splitting the
+// headers and body into frames and respecting the client's flow control.
+func (hc *h2Conn) writeResponse(streamID uint32, resp *StoredResponse) error {
+	block := hpackAppendField(nil, ":status", strconv.Itoa(resp.Status))
+	for key, value := range resp.Headers {
+		name := strings.ToLower(key)
+		switch name {
+		// Connection-specific headers are not allowed in HTTP/2.
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade", "content-length":
+			continue
+		}
+		block = hpackAppendField(block, name, value)
+		for _, more := range resp.MoreHeaders[key] {
+			block = hpackAppendField(block, name, more)
+		}
+	}
+	if resp.Status != 204 && resp.Status != 304 {
+		block = hpackAppendField(block, "content-length", strconv.Itoa(len(resp.Body)))
+	}
+
+	typ, flags := byte(frameHeaders), byte(0)
+	if len(resp.Body) == 0 {
+		flags = flagEndStream
+	}
+	for {
+		n := min(len(block), hc.maxFrameSize)
+		if n == len(block) {
+			flags |= flagEndHeaders
+		}
+		if err := hc.writeFrame(typ, flags, streamID, block[:n]); err != nil {
+			return err
+		}
+		block = block[n:]
+		if len(block) == 0 {
+			break
+		}
+		typ, flags = frameContinuation, 0
+	}
+
+	body := resp.Body
+	for len(body) > 0 {
+		n := int64(min(len(body), hc.maxFrameSize))
+		n = min(n, hc.connWindow, hc.streamWindow)
+		if n <= 0 {
+			if err := hc.awaitWindow(streamID); err != nil {
+				return err
+			}
+			continue
+		}
+		flags := byte(0)
+		if int(n) == len(body) {
+			flags = flagEndStream
+		}
+		if err := hc.writeFrame(frameData, flags, streamID, body[:n]); err != nil {
+			return err
+		}
+		hc.connWindow -= n
+		hc.streamWindow -= n
+		body = body[n:]
+	}
+	return nil
+}
+
+// awaitWindow reads frames until the client grants more flow-control window.
+func (hc *h2Conn) awaitWindow(streamID uint32) error {
+	for {
+		f, err := hc.readFrame()
+		if err != nil {
+			return err
+		}
+		if _, err := hc.handleControl(f, streamID); err != nil {
+			return err
+		}
+		if f.typ == frameRSTStream && f.stream == streamID {
+			return errStreamReset
+		}
+		if f.typ == frameWindowUpdate || f.typ == frameSettings {
+			return nil
+		}
+	}
+}
+
+func (hc *h2Conn) readFrame() (h2Frame, error) {
+	var hdr [9]byte
+	if _, err := io.ReadFull(hc.r, hdr[:]); err != nil {
+		return h2Frame{}, err
+	}
+	length := int(hdr[0])<<16 | int(hdr[1])<<8 | int(hdr[2])
+	if length > h2MaxFrameSize {
+		return h2Frame{}, fmt.Errorf("frame of %d bytes exceeds %d", length, h2MaxFrameSize)
+	}
+	f := h2Frame{
+		typ:     hdr[3],
+		flags:   hdr[4],
+		stream:  binary.BigEndian.Uint32(hdr[5:]) & 0x7fffffff,
+		payload: make([]byte, length),
+	}
+	_, err := io.ReadFull(hc.r, f.payload)
+	return f, err
+}
+
+func (hc *h2Conn) writeFrame(typ, flags byte, stream uint32, payload []byte) error {
+	frame := make([]byte, 9, 9+len(payload))
+	frame[0], frame[1], frame[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	frame[3], frame[4] = typ, flags
+	binary.BigEndian.PutUint32(frame[5:], stream)
+	_, err := hc.conn.Write(append(frame, payload...))
+	return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// h2Client is the client end of an h2c connection in tests.
+type h2Client struct {
+	t    *testing.T
+	conn net.Conn
+	hc   *h2Conn // Used for its frame reading and writing.
+}
+
+func dialH2C(t *testing.T, addr string) *h2Client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &h2Client{t: t, conn: conn, hc: &h2Conn{conn: conn, r: bufio.NewReader(conn)}}
+}
+
+// setting encodes one SETTINGS parameter.
+func setting(id uint16, val uint32) []byte {
+	return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint16(nil, id), val)
+}
+
+// startPriorKnowledge sends the connection preface and SETTINGS.
+func (c *h2Client) startPriorKnowledge(settings ...[]byte) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, h2Preface); err != nil {
+		c.t.Fatal(err)
+	}
+	var payload []byte
+	for _, s := range settings {
+		payload = append(payload, s...)
+	}
+	if err := c.hc.writeFrame(frameSettings, 0, 0, payload); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// sendGet sends a GET for path on stream, with the pseudo-headers encoded
+// as literals.
+func (c *h2Client) sendGet(stream uint32, path string) {
+	c.t.Helper()
+	block := hpackAppendField(nil, ":method", "GET")
+	block = hpackAppendField(block, ":scheme", "http")
+	block = hpackAppendField(block, ":path", path)
+	block = hpackAppendField(block, ":authority", "example.com")
+	if err := c.hc.writeFrame(frameHeaders, flagEndHeaders|flagEndStream, stream, block); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// readResponse reads frames until stream ends and returns the response's
+// header fields and body.
+func (c *h2Client) readResponse(stream uint32) (map[string]string, string) {
+	c.t.Helper()
+	dec := newHpackDecoder()
+	headers := make(map[string]string)
+	var body strings.Builder
+	for {
+		f, err := c.hc.readFrame()
+		if err != nil {
+			c.t.Fatalf("reading frames: %v", err)
+		}
+		if f.stream != stream {
+			if f.typ == frameGoAway {
+				c.t.Fatalf("GOAWAY before the response, error code %d", binary.BigEndian.Uint32(f.payload[4:]))
+			}
+			continue
+		}
+		switch f.typ {
+		case frameHeaders:
+			fields, err := dec.decode(f.payload)
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			for _, field := range fields {
+				headers[field.name] = field.value
+			}
+		case frameData:
+			body.Write(f.payload)
+		}
+		if f.flags&flagEndStream != 0 && (f.typ == frameHeaders || f.typ == frameData) {
+			return headers, body.String()
+		}
+	}
+}
+
+// readGoAway reads frames until a GOAWAY and returns its error code.
+func (c *h2Client) readGoAway() uint32 {
+	c.t.Helper()
+	for {
+		f, err := c.hc.readFrame()
+		if err != nil {
+			c.t.Fatalf("no GOAWAY: %v", err)
+		}
+		if f.typ == frameGoAway {
+			return binary.BigEndian.Uint32(f.payload[4:])
+		}
+	}
+}
+
+func newH2CServer(t *testing.T) string {
+	s := NewServer("")
+	s.EnableH2C = true
+	s.Handle("GET", "/hello", func(w ResponseWriter, r *Request) {
+		w.SetHeader("Content-Type", "text/plain")
+		w.Write([]byte("hello " + r.Version + " " + r.Headers["Host"]))
+	})
+	return startServer(t, s)
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	c := dialH2C(t, newH2CServer(t))
+	c.startPriorKnowledge()
+	c.sendGet(1, "/hello")
+	headers, body := c.readResponse(1)
+	if headers[":status"] != "200" || headers["content-type"] != "text/plain" {
+		t.Errorf("headers = %v", headers)
+	}
+	if body != "hello HTTP/2.0 example.com" {
+		t.Errorf("body = %q", body)
+	}
+	if code := c.readGoAway(); code != 0 {
+		t.Errorf("GOAWAY error code = %d, want NO_ERROR", code)
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	c := dialH2C(t, newH2CServer(t))
+	io.WriteString(c.conn, "GET /hello HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAoAAAAAIAAAAA\r\n\r\n")
+	status, err := c.hc.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(status, "HTTP/1.1 101 ") {
+		t.Fatalf("status line = %q, %v; want 101", status, err)
+	}
+	for {
+		line, err := c.hc.r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	c.startPriorKnowledge()
+	// The upgrade request is answered on stream 1.
+	headers, body := c.readResponse(1)
+	if headers[":status"] != "200" || body != "hello HTTP/1.1 example.com" {
+		t.Errorf("response = %v %q", headers, body)
+	}
+}
+
+func TestH2CInvalidSettings(t *testing.T) {
+	addr := newH2CServer(t)
+	tests := []struct {
+		name    string
+		setting []byte
+		code    uint32
+	}{
+		{"max frame size 0", setting(settingMaxFrameSize, 0), errCodeProtocol},
+		{"max frame size too small", setting(settingMaxFrameSize, 16383), errCodeProtocol},
+		{"max frame size too large", setting(settingMaxFrameSize, 1<<24), errCodeProtocol},
+		{"initial window too large", setting(settingInitialWindowSize, 1<<31), errCodeFlowControl},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialH2C(t, addr)
+			c.startPriorKnowledge(tt.setting)
+			c.sendGet(1, "/hello")
+			if code := c.readGoAway(); code != tt.code {
+				t.Errorf("GOAWAY error code = %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestH2CLargeFrameSize(t *testing.T) {
+	c := dialH2C(t, newH2CServer(t))
+	c.startPriorKnowledge(setting(settingMaxFrameSize, 1<<24-1))
+	c.sendGet(1, "/hello")
+	if headers, body := c.readResponse(1); headers[":status"] != "200" || body == "" {
+		t.Errorf("response = %v %q", headers, body)
+	}
+}
+
+func TestH2CDisabled(t *testing.T) {
+	s := NewServer("")
+	s.Handle("GET", "/hello", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("hello " + r.Version))
+	})
+	addr := startServer(t, s)
+
+	// Without EnableH2C the upgrade header is ignored.
+	resp := rawRequest(t, addr, "GET /hello HTTP/1.1\r\nHost: x\r\nConnection: Upgrade, HTTP2-Settings, close\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAoAAAAAIAAAAA\r\n\r\n")
+	if !strings.HasPrefix(resp, "HTTP/1.1 200 ") || !strings.HasSuffix(resp, "hello HTTP/1.1") {
+		t.Errorf("response = %q, want a plain HTTP/1.1 200", resp)
+	}
+}
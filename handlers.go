@@ -7,29 +7,202 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"mime"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // --- Middleware ---
 
 func loggingMiddleware(next HandlerFunc) HandlerFunc {
 	return func(w ResponseWriter, r *Request) {
-		startTime := time.Now()
+		duration, ttfb := timeHandler(next, w, r)
+		logRequest("Request", w, r, duration, ttfb)
+	}
+}
+
+// SlowRequestLogMiddleware is a quieter loggingMiddleware: it only logs
+// requests whose handler took longer than threshold.
+func SlowRequestLogMiddleware(threshold time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			duration, ttfb := timeHandler(next, w, r)
+			if duration > threshold {
+				logRequest("Slow request", w, r, duration, ttfb)
+			}
+		}
+	}
+}
+
+// HTTPSRedirectMiddleware permanently redirects plain HTTP requests to the
+// same URL over HTTPS. Path and query are copied byte for byte, so nothing
+// gets re-encoded on the way. Requests served over TLS (see
+// ListenAndServeTLS), and those that a TLS-terminating proxy marked with
+// "X-Forwarded-Proto: https", pass through. The host is the public one as
+// seen by the client, see Request.Host.
+func HTTPSRedirectMiddleware(next HandlerFunc) HandlerFunc {
+	return func(w ResponseWriter, r *Request) {
+		if _, ok := r.Conn.(*tls.Conn); ok || strings.EqualFold(r.Headers["X-Forwarded-Proto"], "https") {
+			next(w, r)
+			return
+		}
+		host := r.Host()
+		if host == "" {
+			httpError(w, r, 400)
+			return
+		}
+		// The plain HTTP port means nothing for HTTPS.
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+			if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+		}
+		target := "https://" + host + r.Path
+		if r.RawQuery != "" {
+			target += "?" + r.RawQuery
+		}
+		Redirect(w, r, target, 308)
+	}
+}
+
+// UTF8ValidationMiddleware rejects with a 400 any request whose path or
+// headers aren't valid UTF-8, so handlers never see malformed sequences that
+// could slip past their checks. The path is checked both as sent and
+// percent-decoded, since "%C0%AF" is as malformed as the raw bytes. Header
+// names are checked along with the values: they are kept as the client sent
+// them, and no normalization happens that would fix them up.
+func UTF8ValidationMiddleware(next HandlerFunc) HandlerFunc {
+	return func(w ResponseWriter, r *Request) {
+		if !validUTF8Request(r) {
+			httpError(w, r, 400)
+			return
+		}
 		next(w, r)
-		duration := time.Since(startTime)
-		log.Printf(
-			`Request: "%s %s" | Response: "%d %s" | Duration: %s`,
-			r.Method, r.Path, w.Status(), StatusText(w.Status()), duration,
-		)
 	}
 }
 
+func validUTF8Request(r *Request) bool {
+	if !utf8.ValidString(r.Path) {
+		return false
+	}
+	if path, err := url.PathUnescape(r.Path); err != nil || !utf8.ValidString(path) {
+		return false
+	}
+	for name, value := range r.Headers {
+		if !utf8.ValidString(name) || !utf8.ValidString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// RequireContentType answers 415 to POST, PUT and PATCH requests whose
+// Content-Type isn't one of types, e.g. RequireContentType("application/json").
+// Parameters like charset are ignored in the comparison. Other methods pass
+// through unchecked.
+func RequireContentType(types ...string) Middleware {
+	allowed := make(map[string]bool, len(types))
+	for _, t := range types {
+		allowed[strings.ToLower(t)] = true
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			switch r.Method {
+			case "POST", "PUT", "PATCH":
+				mediaType, _, err := mime.ParseMediaType(r.Headers["Content-Type"])
+				if err != nil || !allowed[mediaType] {
+					httpError(w, r, 415)
+					return
+				}
+			}
+			next(w, r)
+		}
+	}
+}
+
+// ValidateRequest runs fn on every request before the handler, e.g. to check
+// required headers or the shape of the body, and answers with status and the
+// error's message if it fails. With Server.ProblemDetails on, the message is
+// the detail of a problem details response.
+func ValidateRequest(fn func(*Request) error, status int) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			err := fn(r)
+			if err == nil {
+				next(w, r)
+				return
+			}
+			if r.server != nil && r.server.ProblemDetails {
+				WriteProblem(w, status, StatusText(status), err.Error())
+				return
+			}
+			w.SetHeader("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
+
+// defaultMaxStackBytes is how much of a panic's stack trace is logged when
+// RecoveryMiddleware isn't given a limit.
+const defaultMaxStackBytes = 8 << 10
+
+// RecoveryMiddleware turns a panicking handler into a 500 instead of letting
+// it take the whole server down. The panic is logged with its stack trace,
+// cut to maxStackBytes (defaultMaxStackBytes if zero or less).
+func RecoveryMiddleware(maxStackBytes int) Middleware {
+	if maxStackBytes <= 0 {
+		maxStackBytes = defaultMaxStackBytes
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			defer func() {
+				if err := recover(); err != nil {
+					stack := debug.Stack()
+					if len(stack) > maxStackBytes {
+						stack = append(stack[:maxStackBytes:maxStackBytes], "\n... (truncated)"...)
+					}
+					log.Printf("Panic serving %s %s: %v\n%s", r.Method, r.Path, err, stack)
+					httpError(w, r, 500)
+				}
+			}()
+			next(w, r)
+		}
+	}
+}
+
+// timeHandler runs next and returns how long it took, and how long it took
+// to start the response (its time to first byte). ttfb is zero if the
+// handler wrote nothing at all.
+func timeHandler(next HandlerFunc, w ResponseWriter, r *Request) (duration, ttfb time.Duration) {
+	startTime := time.Now()
+	next(w, r)
+	duration = time.Since(startTime)
+	if first := w.FirstWrite(); !first.IsZero() {
+		ttfb = first.Sub(startTime)
+	}
+	return duration, ttfb
+}
+
+func logRequest(label string, w ResponseWriter, r *Request, duration, ttfb time.Duration) {
+	log.Printf(
+		`%s: "%s %s" | Request size: %d | Response: "%d %s" | TTFB: %s | Duration: %s`,
+		label, r.Method, r.Path, r.bodySize(), w.Status(), StatusText(w.Status()), ttfb, duration,
+	)
+}
+
 // --- Page Handlers ---
 
 func homeHandler(w ResponseWriter, r *Request) {
@@ -43,34 +216,157 @@ func aboutHandler(w ResponseWriter, r *Request) {
 }
 
 func submitHandler(w ResponseWriter, r *Request) {
-	responseMessage := fmt.Sprintf("Received your POST request with body:\n%s", r.Body)
+	responseMessage := fmt.Sprintf("Received your POST request with body:\n%s", r.Body())
 	w.SetHeader("Content-Type", "text/plain; charset=utf-8")
 	w.Write([]byte(responseMessage))
 }
 
+// --- Built-in Handlers ---
+
+// DefaultRobotsPolicy allows every crawler everywhere.
+const DefaultRobotsPolicy = "User-agent: *\nDisallow:\n"
+
+// DefaultRobotsHandler serves DefaultRobotsPolicy as /robots.txt. Like
+// DefaultFaviconHandler, it is for sites without a file of their own and is
+// only used where it is registered.
+var DefaultRobotsHandler = RobotsHandler(DefaultRobotsPolicy)
+
+// RobotsHandler serves the given policy as a robots.txt file.
+func RobotsHandler(policy string) HandlerFunc {
+	return func(w ResponseWriter, r *Request) {
+		w.SetHeader("Content-Type", "text/plain; charset=utf-8")
+		w.SetHeader("Cache-Control", "public, max-age=86400")
+		w.Write([]byte(policy))
+	}
+}
+
+// DefaultFaviconHandler answers /favicon.ico with an empty 204 that browsers
+// may cache for a day, which stops them asking on every page load.
+func DefaultFaviconHandler(w ResponseWriter, r *Request) {
+	w.SetHeader("Cache-Control", "public, max-age=86400")
+	NoContent(w)
+}
+
+// StaticContentHandler serves body, computed once up front (e.g. a generated
+// sitemap), with an ETag taken from its SHA-256 hash. A client that sends the
+// ETag back in If-None-Match gets a 304 instead of the content again. body is
+// copied, so later changes to the caller's slice don't show.
+func StaticContentHandler(contentType string, body []byte) HandlerFunc {
+	body = append([]byte(nil), body...)
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	return func(w ResponseWriter, r *Request) {
+		w.SetHeader("ETag", etag)
+		if etagMatches(r, etag) {
+			w.WriteHeader(304)
+			return
+		}
+		w.SetHeader("Content-Type", contentType)
+		w.Write(body)
+	}
+}
+
 // --- File & Error Handlers ---
 
 func serveStaticFile(w ResponseWriter, r *Request) {
-	// This handler is now used as a fallback. We only serve files for GET requests.
-	if r.Method != "GET" {
-		httpError(w, 405) // Method Not Allowed
+	// This handler is now used as a fallback.
+	cleanPath, ok := staticPath(w, r)
+	if !ok {
 		return
 	}
-	
+
+	filePath := filepath.Join(staticRoot, cleanPath)
+	info, err := os.Stat(filePath)
+	hashed := false
+	if err != nil {
+		// It may be a cache-busted name from AssetURL.
+		if assetPath, ok := resolveHashedAsset(cleanPath); ok {
+			filePath, hashed = assetPath, true
+			info, err = os.Stat(filePath)
+		}
+	}
+	if err != nil || info.IsDir() {
+		// If the file doesn't exist, this is a 404.
+		httpError(w, r, 404)
+		return
+	}
+	if hashed {
+		// The URL changes with the content, so it never needs revalidating.
+		w.SetHeader("Cache-Control", immutableCacheControl)
+	}
+	serveFile(w, r, filePath, info)
+}
+
+// MultiFileServer serves files from several directories, e.g. "public" and
+// "vendor". Each is tried in order and the first that has the file serves
+// it; only if none has it is the answer a 404.
+func MultiFileServer(roots ...string) HandlerFunc {
+	return func(w ResponseWriter, r *Request) {
+		cleanPath, ok := staticPath(w, r)
+		if !ok {
+			return
+		}
+		for _, root := range roots {
+			filePath := filepath.Join(root, cleanPath)
+			if info, err := os.Stat(filePath); err == nil && !info.IsDir() {
+				serveFile(w, r, filePath, info)
+				return
+			}
+		}
+		httpError(w, r, 404)
+	}
+}
+
+// staticPath returns the request path as a clean path relative to a static
+// root. If the request can't be for a static file, it answers it and returns
+// false: only GET is served, and a path escaping the root is rejected.
+func staticPath(w ResponseWriter, r *Request) (string, bool) {
+	if r.Method != "GET" {
+		w.SetHeader("Allow", "GET")
+		httpError(w, r, 405) // Method Not Allowed
+		return "", false
+	}
+
 	cleanPath := filepath.Clean(strings.TrimPrefix(r.Path, "/"))
 	if strings.HasPrefix(cleanPath, "..") {
-		httpError(w, 400) // Bad Request
+		httpError(w, r, 400) // Bad Request
+		return "", false
+	}
+	return cleanPath, true
+}
+
+// serveFile sends the file at filePath, whose info the caller already has.
+// A precompressed copy of it is sent instead if the client accepts one.
+func serveFile(w ResponseWriter, r *Request, filePath string, info os.FileInfo) {
+	variantPath, coding, variants, ok := precompressedVariant(r, filePath)
+	if variants {
+		w.SetHeader("Vary", "Accept-Encoding")
+	}
+	if !ok {
+		// The client refused the plain file and takes none of the copies.
+		httpError(w, r, 406)
 		return
 	}
 
-	filePath := filepath.Join("public", cleanPath)
-	data, err := os.ReadFile(filePath)
+	// The client's cached copy is still good, no need to send it again.
+	w.SetHeader("Last-Modified", info.ModTime().UTC().Format(TimeFormat))
+	if notModified(r, info.ModTime()) {
+		w.WriteHeader(304)
+		return
+	}
+
+	readPath := filePath
+	if variantPath != "" {
+		readPath = variantPath
+		w.SetHeader("Content-Encoding", coding)
+	}
+	data, err := os.ReadFile(readPath)
 	if err != nil {
-		// If the file doesn't exist, this is a 404.
-		httpError(w, 404)
+		httpError(w, r, 404)
 		return
 	}
 
+	// The type is that of the file itself, whatever encoding it is sent in.
 	contentType := mime.TypeByExtension(filepath.Ext(filePath))
 	if contentType == "" {
 		contentType = "application/octet-stream"
@@ -79,4 +375,4 @@ func serveStaticFile(w ResponseWriter, r *Request) {
 	w.SetHeader("Content-Type", contentType)
 	w.WriteHeader(200)
 	w.Write(data)
-}
\ No newline at end of file
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowRequestLogMiddleware(t *testing.T) {
+	logs := captureLog(t)
+	mw := SlowRequestLogMiddleware(50 * time.Millisecond)
+	fast := mw(func(w ResponseWriter, r *Request) {
+		w.Write([]byte("fast"))
+	})
+	slow := mw(func(w ResponseWriter, r *Request) {
+		time.Sleep(80 * time.Millisecond)
+		w.WriteHeader(404)
+	})
+
+	serveRecorded(fast, newTestRequest("GET", "/fast", nil, ""))
+	if logs.String() != "" {
+		t.Errorf("fast request logged: %q", logs.String())
+	}
+	serveRecorded(slow, newTestRequest("POST", "/slow", nil, ""))
+	got := logs.String()
+	for _, want := range []string{`Slow request: "POST /slow"`, `Response: "404 Not Found"`, "Duration: "} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log %q doesn't contain %q", got, want)
+		}
+	}
+}
+
+// panicDeep panics depth calls down, for a long stack trace.
+func panicDeep(depth int) {
+	if depth == 0 {
+		panic("boom")
+	}
+	panicDeep(depth - 1)
+}
+
+func TestRecoveryMiddlewareStackLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		want  int // Most bytes of stack expected in the log.
+	}{
+		{"configured", 512, 512},
+		{"default", 0, defaultMaxStackBytes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			h := RecoveryMiddleware(tt.limit)(func(w ResponseWriter, r *Request) {
+				panicDeep(200)
+			})
+			if res := serveRecorded(h, newTestRequest("GET", "/", nil, "")); res.Status != 500 {
+				t.Errorf("status = %d, want 500", res.Status)
+			}
+			_, stack, ok := strings.Cut(logs.String(), "boom\n")
+			if !ok {
+				t.Fatalf("log %q doesn't contain the panic", logs.String())
+			}
+			stack, truncated := strings.CutSuffix(strings.TrimSuffix(stack, "\n"), "\n... (truncated)")
+			// The runtime elides frames past a hundred, so the default
+			// limit may not need to cut anything.
+			if (tt.limit > 0 && !truncated) || len(stack) > tt.want || !strings.Contains(stack, "goroutine ") {
+				t.Errorf("logged %d bytes of stack (truncated: %v), want at most %d", len(stack), truncated, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPSRedirectMiddleware(t *testing.T) {
+	h := HTTPSRedirectMiddleware(func(w ResponseWriter, r *Request) {
+		w.Write([]byte("secure"))
+	})
+	tests := []struct {
+		name     string
+		target   string
+		headers  map[string]string
+		location string // Empty means the request passes through.
+	}{
+		{"exact query", "/search?q=a+b", map[string]string{"Host": "example.com"}, "https://example.com/search?q=a+b"},
+		{"escapes kept", "/caf%C3%A9/a%2Fb?x=%2F&y", map[string]string{"Host": "example.com"}, "https://example.com/caf%C3%A9/a%2Fb?x=%2F&y"},
+		{"no query", "/login", map[string]string{"Host": "example.com"}, "https://example.com/login"},
+		{"port dropped", "/", map[string]string{"Host": "example.com:8080"}, "https://example.com/"},
+		{"IPv6 host", "/", map[string]string{"Host": "[::1]:8080"}, "https://[::1]/"},
+		{"behind TLS proxy", "/", map[string]string{"Host": "example.com", "X-Forwarded-Proto": "https"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := serveRecorded(h, newTestRequest("GET", tt.target, tt.headers, ""))
+			if tt.location == "" {
+				if res.Status != 200 || string(res.Body) != "secure" {
+					t.Errorf("response = %d %q, want it passed through", res.Status, res.Body)
+				}
+				return
+			}
+			if res.Status != 308 || res.Headers["Location"] != tt.location {
+				t.Errorf("response = %d to %q, want 308 to %q", res.Status, res.Headers["Location"], tt.location)
+			}
+		})
+	}
+}
+
+func TestDefaultRobotsHandler(t *testing.T) {
+	res := serveRecorded(DefaultRobotsHandler, newTestRequest("GET", "/robots.txt", nil, ""))
+	if res.Status != 200 || string(res.Body) != "User-agent: *\nDisallow:\n" {
+		t.Errorf("response = %d %q", res.Status, res.Body)
+	}
+	if ct := res.Headers["Content-Type"]; ct != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	policy := "User-agent: *\nDisallow: /admin/\n"
+	if res := serveRecorded(RobotsHandler(policy), newTestRequest("GET", "/robots.txt", nil, "")); string(res.Body) != policy {
+		t.Errorf("custom policy: body = %q, want %q", res.Body, policy)
+	}
+}
+
+func TestDefaultFaviconHandler(t *testing.T) {
+	res := serveRecorded(DefaultFaviconHandler, newTestRequest("GET", "/favicon.ico", nil, ""))
+	if res.Status != 204 || len(res.Body) != 0 {
+		t.Errorf("response = %d %q, want an empty 204", res.Status, res.Body)
+	}
+	if cc := res.Headers["Cache-Control"]; !strings.Contains(cc, "max-age=") {
+		t.Errorf("Cache-Control = %q, want it cacheable", cc)
+	}
+}
+
+func TestStaticContentHandler(t *testing.T) {
+	body := []byte(`<?xml version="1.0"?><urlset></urlset>`)
+	h := StaticContentHandler("application/xml", body)
+	// The handler keeps its own copy.
+	body[0] = 'X'
+
+	first := serveRecorded(h, newTestRequest("GET", "/sitemap.xml", nil, ""))
+	etag := first.Headers["ETag"]
+	if first.Status != 200 || !strings.HasPrefix(string(first.Body), "<?xml") || first.Headers["Content-Type"] != "application/xml" {
+		t.Fatalf("first response = %d %q %v", first.Status, first.Body, first.Headers)
+	}
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		t.Fatalf("ETag = %q, want a quoted tag", etag)
+	}
+
+	for _, inm := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		res := serveRecorded(h, newTestRequest("GET", "/sitemap.xml", map[string]string{"If-None-Match": inm}, ""))
+		if res.Status != 304 || len(res.Body) != 0 || res.Headers["ETag"] != etag {
+			t.Errorf("If-None-Match %s: response = %d %q, want an empty 304 with the ETag", inm, res.Status, res.Body)
+		}
+	}
+	if res := serveRecorded(h, newTestRequest("GET", "/sitemap.xml", map[string]string{"If-None-Match": `"stale"`}, "")); res.Status != 200 {
+		t.Errorf("stale ETag: status = %d, want 200", res.Status)
+	}
+}
+
+func TestUTF8ValidationMiddleware(t *testing.T) {
+	s := NewServer("")
+	s.Use(UTF8ValidationMiddleware)
+	s.Handle("GET", "/:name", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("ok"))
+	})
+	addr := startServer(t, s)
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		status string
+	}{
+		{"valid", "/caf\xc3\xa9", "", "200"},
+		{"valid escaped", "/caf%C3%A9", "X-Name: caf\xc3\xa9", "200"},
+		{"invalid byte", "/caf\xe9", "", "400"},
+		{"invalid escaped", "/%C0%AF", "", "400"},
+		{"bad escape", "/%zz", "", "400"},
+		{"invalid header value", "/a", "X-Name: \xff\xfe", "400"},
+		{"invalid header name", "/a", "X-\xff: 1", "400"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "GET " + tt.path + " HTTP/1.1\r\nHost: x\r\nConnection: close\r\n"
+			if tt.header != "" {
+				raw += tt.header + "\r\n"
+			}
+			if resp := rawRequest(t, addr, raw+"\r\n"); !strings.HasPrefix(resp, "HTTP/1.1 "+tt.status+" ") {
+				t.Errorf("response = %q, want %s", resp, tt.status)
+			}
+		})
+	}
+}
+
+func TestTimeHandlerTTFB(t *testing.T) {
+	s := NewServer("")
+	type timing struct{ ttfb, duration time.Duration }
+	timings := make(chan timing, 1)
+	s.Use(func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			duration, ttfb := timeHandler(next, w, r)
+			timings <- timing{ttfb, duration}
+		}
+	})
+	s.Handle("GET", "/write-then-sleep", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("early"))
+		time.Sleep(30 * time.Millisecond)
+	})
+	s.Handle("GET", "/sleep-then-write", func(w ResponseWriter, r *Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.WriteHeader(200)
+	})
+	s.Handle("GET", "/silent", func(w ResponseWriter, r *Request) {})
+	addr := startServer(t, s)
+	get := func(path string) timing {
+		rawRequest(t, addr, "GET "+path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		return <-timings
+	}
+
+	got := get("/write-then-sleep")
+	if got.ttfb <= 0 || got.ttfb > got.duration || got.ttfb >= 30*time.Millisecond || got.duration < 30*time.Millisecond {
+		t.Errorf("write then sleep: TTFB %v, duration %v; want an early first byte", got.ttfb, got.duration)
+	}
+	got = get("/sleep-then-write")
+	if got.ttfb < 30*time.Millisecond || got.ttfb > got.duration {
+		t.Errorf("sleep then write: TTFB %v, duration %v; want a late first byte", got.ttfb, got.duration)
+	}
+	if got = get("/silent"); got.ttfb != 0 {
+		t.Errorf("no write: TTFB = %v, want 0", got.ttfb)
+	}
+}
+
+func TestRequireContentType(t *testing.T) {
+	h := RequireContentType("application/json", "application/merge-patch+json")(func(w ResponseWriter, r *Request) {
+		w.Write([]byte("ok"))
+	})
+	tests := []struct {
+		method, contentType string
+		status              int
+	}{
+		{"POST", "application/json", 200},
+		{"PUT", "application/json; charset=utf-8", 200},
+		{"PATCH", "Application/Merge-Patch+JSON", 200},
+		{"POST", "text/plain", 415},
+		{"PUT", "application/x-www-form-urlencoded", 415},
+		{"POST", "", 415},
+		{"GET", "text/plain", 200}, // No body to check.
+		{"DELETE", "", 200},
+	}
+	for _, tt := range tests {
+		headers := map[string]string{}
+		if tt.contentType != "" {
+			headers["Content-Type"] = tt.contentType
+		}
+		res := serveRecorded(h, newTestRequest(tt.method, "/items", headers, "{}"))
+		if res.Status != tt.status {
+			t.Errorf("%s with %q: status = %d, want %d", tt.method, tt.contentType, res.Status, tt.status)
+		}
+	}
+	if got := StatusText(415); got != "Unsupported Media Type" {
+		t.Errorf("StatusText(415) = %q", got)
+	}
+}
+
+// writeFiles creates the given files, with their parent directories, under dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMultiFileServer(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"public/index.html":  "public index",
+		"public/shared.css":  "public css",
+		"vendor/shared.css":  "vendor css",
+		"vendor/lib/app.js":  "vendor js",
+		"secret.txt":         "secret",
+		"public/sub/pic.txt": "pic",
+	})
+	h := MultiFileServer(filepath.Join(dir, "public"), filepath.Join(dir, "vendor"))
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/index.html", 200, "public index"},
+		{"/lib/app.js", 200, "vendor js"},  // Only in the second root.
+		{"/shared.css", 200, "public css"}, // The first root wins.
+		{"/missing.js", 404, ""},
+		{"/sub", 404, ""}, // Directories aren't served.
+		{"/../secret.txt", 400, ""},
+		{"/lib/../../secret.txt", 400, ""},
+	}
+	for _, tt := range tests {
+		res := serveRecorded(h, newTestRequest("GET", tt.path, nil, ""))
+		if res.Status != tt.status || (tt.body != "" && string(res.Body) != tt.body) {
+			t.Errorf("%s: response = %d %q, want %d %q", tt.path, res.Status, res.Body, tt.status, tt.body)
+		}
+	}
+	if res := serveRecorded(h, newTestRequest("POST", "/index.html", nil, "")); res.Status != 405 || res.Headers["Allow"] != "GET" {
+		t.Errorf("POST: response = %d with Allow %q, want 405 with GET", res.Status, res.Headers["Allow"])
+	}
+}
+
+func TestLoggingMiddlewareRequestSize(t *testing.T) {
+	logs := captureLog(t)
+	s := NewServer("")
+	s.Use(loggingMiddleware)
+	s.Handle("POST", "/upload", func(w ResponseWriter, r *Request) {
+		r.Body()
+	})
+	addr := startServer(t, s)
+
+	tests := []struct {
+		name, request, want string
+	}{
+		{"Content-Length", "Content-Length: 1234\r\n\r\n" + strings.Repeat("x", 1234), "Request size: 1234 |"},
+		{"chunked", "Transfer-Encoding: chunked\r\n\r\n400\r\n" + strings.Repeat("x", 1024) + "\r\n7\r\n" + strings.Repeat("x", 7) + "\r\n0\r\n\r\n", "Request size: 1031 |"},
+	}
+	for _, tt := range tests {
+		rawRequest(t, addr, "POST /upload HTTP/1.1\r\nHost: x\r\nConnection: close\r\n"+tt.request)
+		if got := logs.String(); !strings.Contains(got, tt.want) {
+			t.Errorf("%s: log %q doesn't contain %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	mw := ValidateRequest(func(r *Request) error {
+		if r.Headers["X-Api-Version"] == "" {
+			return errors.New("X-Api-Version is required")
+		}
+		return nil
+	}, 422)
+	h := mw(func(w ResponseWriter, r *Request) {
+		w.Write([]byte("handled"))
+	})
+
+	got := serveRecorded(h, newTestRequest("GET", "/", map[string]string{"X-Api-Version": "2"}, ""))
+	if got.Status != 200 || string(got.Body) != "handled" {
+		t.Errorf("valid request: response = %d %q, want the handler's", got.Status, got.Body)
+	}
+
+	got = serveRecorded(h, newTestRequest("GET", "/", nil, ""))
+	if got.Status != 422 || string(got.Body) != "X-Api-Version is required" || !strings.HasPrefix(got.Headers["Content-Type"], "text/plain") {
+		t.Errorf("invalid request: response = %d %q (%s), want 422 with the error", got.Status, got.Body, got.Headers["Content-Type"])
+	}
+
+	r := newTestRequest("GET", "/", nil, "")
+	r.server = &Server{ProblemDetails: true}
+	got = serveRecorded(h, r)
+	if got.Status != 422 || got.Headers["Content-Type"] != "application/problem+json" || !strings.Contains(string(got.Body), `"detail":"X-Api-Version is required"`) {
+		t.Errorf("with problem details: response = %d %q (%s)", got.Status, got.Body, got.Headers["Content-Type"])
+	}
+}
@@ -0,0 +1,365 @@
+// hpack.go
+// This file contains the HPACK header compression used by HTTP/2 (RFC 7541).
+// The decoder understands every header representation, including Huffman
+// coded strings and the dynamic table. The encoder only emits plain literals,
+// which every peer must accept and which keeps it stateless.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errHpack = errors.New("hpack: malformed header block")
+
+type hpackField struct {
+	name, value string
+}
+
+// size is the space an entry takes up in the dynamic table.
+func (f hpackField) size() int {
+	return len(f.name) + len(f.value) + 32
+}
+
+type hpackDecoder struct {
+	dynamic []hpackField // Newest entry first.
+	size    int
+	maxSize int
+}
+
+func newHpackDecoder() *hpackDecoder {
+	return &hpackDecoder{maxSize: 4096}
+}
+
+// decode turns a complete header block into its list of fields.
+func (d *hpackDecoder) decode(block []byte) ([]hpackField, error) {
+	var fields []hpackField
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // Indexed field.
+			idx, rest, err := hpackReadInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, err := d.at(idx)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, f)
+			block = rest
+		case b&0xc0 == 0x40: // Literal, added to the dynamic table.
+			f, rest, err := d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.add(f)
+			fields = append(fields, f)
+			block = rest
+		case b&0xe0 == 0x20: // Dynamic table size update.
+			size, rest, err := hpackReadInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > 4096 {
+				return nil, fmt.Errorf("hpack: table size %d too large", size)
+			}
+			d.maxSize = int(size)
+			d.evict()
+			block = rest
+		default: // Literal without indexing, or never indexed.
+			f, rest, err := d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, f)
+			block = rest
+		}
+	}
+	return fields, nil
+}
+
+func (d *hpackDecoder) readLiteral(block []byte, prefix uint) (hpackField, []byte, error) {
+	var f hpackField
+	idx, rest, err := hpackReadInt(block, prefix)
+	if err != nil {
+		return f, nil, err
+	}
+	if idx == 0 {
+		f.name, rest, err = hpackReadString(rest)
+		if err != nil {
+			return f, nil, err
+		}
+	} else {
+		named, err := d.at(idx)
+		if err != nil {
+			return f, nil, err
+		}
+		f.name = named.name
+	}
+	f.value, rest, err = hpackReadString(rest)
+	return f, rest, err
+}
+
+// at looks up an index that spans the static table followed by the dynamic one.
+func (d *hpackDecoder) at(idx uint64) (hpackField, error) {
+	if idx == 0 {
+		return hpackField{}, errHpack
+	}
+	if idx <= uint64(len(hpackStaticTable)) {
+		return hpackStaticTable[idx-1], nil
+	}
+	idx -= uint64(len(hpackStaticTable)) + 1
+	if idx >= uint64(len(d.dynamic)) {
+		return hpackField{}, fmt.Errorf("hpack: index %d out of range", idx)
+	}
+	return d.dynamic[idx], nil
+}
+
+func (d *hpackDecoder) add(f hpackField) {
+	d.dynamic = append([]hpackField{f}, d.dynamic...)
+	d.size += f.size()
+	d.evict()
+}
+
+// evict drops the oldest entries until the table fits in maxSize.
+func (d *hpackDecoder) evict() {
+	for d.size > d.maxSize && len(d.dynamic) > 0 {
+		last := d.dynamic[len(d.dynamic)-1]
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+		d.size -= last.size()
+	}
+}
+
+// hpackReadInt decodes an integer stored in the low prefix bits of the first
+// byte, continuing into following bytes if it doesn't fit.
+func hpackReadInt(block []byte, prefix uint) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, errHpack
+	}
+	mask := uint64(1)<<prefix - 1
+	n := uint64(block[0]) & mask
+	block = block[1:]
+	if n < mask {
+		return n, block, nil
+	}
+	var shift uint
+	for len(block) > 0 {
+		b := block[0]
+		block = block[1:]
+		n += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return n, block, nil
+		}
+		shift += 7
+		if shift > 28 {
+			break
+		}
+	}
+	return 0, nil, errHpack
+}
+
+func hpackReadString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, errHpack
+	}
+	huffman := block[0]&0x80 != 0
+	n, rest, err := hpackReadInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(rest)) < n {
+		return "", nil, errHpack
+	}
+	raw, rest := rest[:n], rest[n:]
+	if !huffman {
+		return string(raw), rest, nil
+	}
+	s, err := huffmanDecode(raw)
+	return s, rest, err
+}
+
+// hpackAppendInt is the encoding counterpart of hpackReadInt. first holds the
+// representation bits that share the first byte with the prefix.
+func hpackAppendInt(dst []byte, first byte, prefix uint, n uint64) []byte {
+	mask := uint64(1)<<prefix - 1
+	if n < mask {
+		return append(dst, first|byte(n))
+	}
+	dst = append(dst, first|byte(mask))
+	n -= mask
+	for n >= 0x80 {
+		dst = append(dst, byte(n)|0x80)
+		n >>= 7
+	}
+	return append(dst, byte(n))
+}
+
+// hpackAppendField encodes a field as a literal that is never added to the
+// dynamic table, with both name and value sent as plain strings.
+func hpackAppendField(dst []byte, name, value string) []byte {
+	dst = append(dst, 0)
+	dst = hpackAppendInt(dst, 0, 7, uint64(len(name)))
+	dst = append(dst, name...)
+	dst = hpackAppendInt(dst, 0, 7, uint64(len(value)))
+	return append(dst, value...)
+}
+
+// huffmanSymbols maps a code, keyed by its bit length and value, back to its byte.
+var huffmanSymbols = func() map[uint64]byte {
+	m := make(map[uint64]byte, len(huffmanCodes))
+	for sym, code := range huffmanCodes {
+		m[uint64(huffmanCodeLen[sym])<<32|uint64(code)] = byte(sym)
+	}
+	return m
+}()
+
+// huffmanDecode decodes a string with the static Huffman code from RFC 7541
+// Appendix B. It walks the input a bit at a time, which is plenty fast for
+// the small strings found in headers.
+func huffmanDecode(data []byte) (string, error) {
+	out := make([]byte, 0, len(data)*8/5)
+	var code uint64
+	var n uint
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			code = code<<1 | uint64(b>>uint(i)&1)
+			n++
+			if n < 5 {
+				continue
+			}
+			if sym, ok := huffmanSymbols[uint64(n)<<32|code]; ok {
+				out = append(out, sym)
+				code, n = 0, 0
+			} else if n > 30 {
+				return "", errHpack
+			}
+		}
+	}
+	// Whatever is left must be padding: fewer than 8 bits, all ones.
+	if n >= 8 || code != 1<<n-1 {
+		return "", errHpack
+	}
+	return string(out), nil
+}
+
+var hpackStaticTable = [...]hpackField{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+// huffmanCodes and huffmanCodeLen are the Huffman code table from RFC 7541
+// Appendix B, indexed by symbol.
+var huffmanCodes = [256]uint32{
+	0x1ff8, 0x7fffd8, 0xfffffe2, 0xfffffe3, 0xfffffe4, 0xfffffe5, 0xfffffe6, 0xfffffe7,
+	0xfffffe8, 0xffffea, 0x3ffffffc, 0xfffffe9, 0xfffffea, 0x3ffffffd, 0xfffffeb, 0xfffffec,
+	0xfffffed, 0xfffffee, 0xfffffef, 0xffffff0, 0xffffff1, 0xffffff2, 0x3ffffffe, 0xffffff3,
+	0xffffff4, 0xffffff5, 0xffffff6, 0xffffff7, 0xffffff8, 0xffffff9, 0xffffffa, 0xffffffb,
+	0x14, 0x3f8, 0x3f9, 0xffa, 0x1ff9, 0x15, 0xf8, 0x7fa,
+	0x3fa, 0x3fb, 0xf9, 0x7fb, 0xfa, 0x16, 0x17, 0x18,
+	0x0, 0x1, 0x2, 0x19, 0x1a, 0x1b, 0x1c, 0x1d,
+	0x1e, 0x1f, 0x5c, 0xfb, 0x7ffc, 0x20, 0xffb, 0x3fc,
+	0x1ffa, 0x21, 0x5d, 0x5e, 0x5f, 0x60, 0x61, 0x62,
+	0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6a,
+	0x6b, 0x6c, 0x6d, 0x6e, 0x6f, 0x70, 0x71, 0x72,
+	0xfc, 0x73, 0xfd, 0x1ffb, 0x7fff0, 0x1ffc, 0x3ffc, 0x22,
+	0x7ffd, 0x3, 0x23, 0x4, 0x24, 0x5, 0x25, 0x26,
+	0x27, 0x6, 0x74, 0x75, 0x28, 0x29, 0x2a, 0x7,
+	0x2b, 0x76, 0x2c, 0x8, 0x9, 0x2d, 0x77, 0x78,
+	0x79, 0x7a, 0x7b, 0x7ffe, 0x7fc, 0x3ffd, 0x1ffd, 0xffffffc,
+	0xfffe6, 0x3fffd2, 0xfffe7, 0xfffe8, 0x3fffd3, 0x3fffd4, 0x3fffd5, 0x7fffd9,
+	0x3fffd6, 0x7fffda, 0x7fffdb, 0x7fffdc, 0x7fffdd, 0x7fffde, 0xffffeb, 0x7fffdf,
+	0xffffec, 0xffffed, 0x3fffd7, 0x7fffe0, 0xffffee, 0x7fffe1, 0x7fffe2, 0x7fffe3,
+	0x7fffe4, 0x1fffdc, 0x3fffd8, 0x7fffe5, 0x3fffd9, 0x7fffe6, 0x7fffe7, 0xffffef,
+	0x3fffda, 0x1fffdd, 0xfffe9, 0x3fffdb, 0x3fffdc, 0x7fffe8, 0x7fffe9, 0x1fffde,
+	0x7fffea, 0x3fffdd, 0x3fffde, 0xfffff0, 0x1fffdf, 0x3fffdf, 0x7fffeb, 0x7fffec,
+	0x1fffe0, 0x1fffe1, 0x3fffe0, 0x1fffe2, 0x7fffed, 0x3fffe1, 0x7fffee, 0x7fffef,
+	0xfffea, 0x3fffe2, 0x3fffe3, 0x3fffe4, 0x7ffff0, 0x3fffe5, 0x3fffe6, 0x7ffff1,
+	0x3ffffe0, 0x3ffffe1, 0xfffeb, 0x7fff1, 0x3fffe7, 0x7ffff2, 0x3fffe8, 0x1ffffec,
+	0x3ffffe2, 0x3ffffe3, 0x3ffffe4, 0x7ffffde, 0x7ffffdf, 0x3ffffe5, 0xfffff1, 0x1ffffed,
+	0x7fff2, 0x1fffe3, 0x3ffffe6, 0x7ffffe0, 0x7ffffe1, 0x3ffffe7, 0x7ffffe2, 0xfffff2,
+	0x1fffe4, 0x1fffe5, 0x3ffffe8, 0x3ffffe9, 0xffffffd, 0x7ffffe3, 0x7ffffe4, 0x7ffffe5,
+	0xfffec, 0xfffff3, 0xfffed, 0x1fffe6, 0x3fffe9, 0x1fffe7, 0x1fffe8, 0x7ffff3,
+	0x3fffea, 0x3fffeb, 0x1ffffee, 0x1ffffef, 0xfffff4, 0xfffff5, 0x3ffffea, 0x7ffff4,
+	0x3ffffeb, 0x7ffffe6, 0x3ffffec, 0x3ffffed, 0x7ffffe7, 0x7ffffe8, 0x7ffffe9, 0x7ffffea,
+	0x7ffffeb, 0xffffffe, 0x7ffffec, 0x7ffffed, 0x7ffffee, 0x7ffffef, 0x7fffff0, 0x3ffffee,
+}
+
+var huffmanCodeLen = [256]uint8{
+	13, 23, 28, 28, 28, 28, 28, 28, 28, 24, 30, 28, 28, 30, 28, 28,
+	28, 28, 28, 28, 28, 28, 30, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+	6, 10, 10, 12, 13, 6, 8, 11, 10, 10, 8, 11, 8, 6, 6, 6,
+	5, 5, 5, 6, 6, 6, 6, 6, 6, 6, 7, 8, 15, 6, 12, 10,
+	13, 6, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7,
+	7, 7, 7, 7, 7, 7, 7, 7, 8, 7, 8, 13, 19, 13, 14, 6,
+	15, 5, 6, 5, 6, 5, 6, 6, 6, 5, 7, 7, 6, 6, 6, 5,
+	6, 7, 6, 5, 5, 6, 7, 7, 7, 7, 7, 15, 11, 14, 13, 28,
+	20, 22, 20, 20, 22, 22, 22, 23, 22, 23, 23, 23, 23, 23, 24, 23,
+	24, 24, 22, 23, 24, 23, 23, 23, 23, 21, 22, 23, 22, 23, 23, 24,
+	22, 21, 20, 22, 22, 23, 23, 21, 23, 22, 22, 24, 21, 22, 23, 23,
+	21, 21, 22, 21, 23, 22, 23, 23, 20, 22, 22, 22, 23, 22, 22, 23,
+	26, 26, 20, 19, 22, 23, 22, 25, 26, 26, 26, 27, 27, 26, 24, 25,
+	19, 21, 26, 27, 27, 26, 27, 24, 21, 21, 26, 26, 28, 27, 27, 27,
+	20, 24, 20, 21, 22, 21, 21, 23, 22, 22, 25, 25, 24, 24, 26, 23,
+	26, 27, 26, 26, 27, 27, 27, 27, 27, 28, 27, 27, 27, 27, 27, 26,
+}
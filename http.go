@@ -7,10 +7,20 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
 	"net"
+	"net/textproto"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Request represents a parsed HTTP request, this is passed to handlers as one of the arguments.
@@ -19,75 +29,622 @@ type Request struct {
 	Path    string
 	Version string
 	Headers map[string]string
-	Body    string
 	Conn    net.Conn
+
+	// Trailers holds the trailer fields that follow a chunked body. It is
+	// only filled in once the body has been read to the end.
+	Trailers map[string]string
+
+	// RawQuery is everything after the '?' in the request target, exactly
+	// as sent and still percent-encoded, for handlers that sign or pass on
+	// the query and can't afford it being re-encoded.
+	RawQuery string
+
+	query url.Values // Parsed from RawQuery by parseRequest.
+
+	body       io.Reader // Streams the body off the connection; nil if there is none.
+	bodyText   string    // The whole body, once Body has read it.
+	bodyCached bool
+	bodyRead   int64 // Bytes of a chunked body decoded so far.
+
+	ctx    context.Context
+	values map[string]any // Request-scoped values shared between middleware and handlers.
+	server *Server        // The server handling the request, for its error pages.
+
+	allowedMethods []string          // Set by the router when the path matched but the method didn't.
+	routePattern   string            // The registered route that matched, e.g. "/users/:id".
+	params         map[string]string // Values of the route's parameter segments.
+
+	spansMu sync.Mutex
+	spans   []timingSpan // Finished spans from StartSpan, for Server-Timing.
+}
+
+// AllowedMethods returns the methods the requested path accepts when the
+// request was routed to the method-not-allowed handler, and nil otherwise.
+func (r *Request) AllowedMethods() []string {
+	return r.allowedMethods
+}
+
+// RoutePattern returns the route the request was matched to as it was
+// registered, e.g. "/users/:id" for "/users/42". Unlike the path it has few
+// distinct values, which makes it the thing to group metrics and logs by.
+// It is "" if no route matched.
+func (r *Request) RoutePattern() string {
+	return r.routePattern
+}
+
+// Param returns the value of the named parameter segment of the matched
+// route, or "" if there is no such parameter.
+func (r *Request) Param(name string) string {
+	return r.params[name]
+}
+
+// Context returns the request's context. It is cancelled once the request
+// has been answered, or earlier if writing the response shows the client has
+// gone away, so long-running handlers can stop early. It also carries the
+// deadline the client sent, if any; see Server.MaxRequestDeadline.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// Set stores a value on the request, e.g. for middleware to pass data to handlers.
+func (r *Request) Set(key string, value any) {
+	if r.values == nil {
+		r.values = make(map[string]any)
+	}
+	r.values[key] = value
+}
+
+// Get returns a value stored with Set, or nil.
+func (r *Request) Get(key string) any {
+	return r.values[key]
+}
+
+// Query returns the first value of the named query parameter, or "" if absent.
+func (r *Request) Query(key string) string {
+	return r.query.Get(key)
+}
+
+// QueryValues returns every value of the named query parameter, in the order
+// they appear, e.g. ["1", "2"] for "?id=1&id=2". It is empty if absent.
+func (r *Request) QueryValues(key string) []string {
+	values := r.query[key]
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+// BearerToken returns the token from an "Authorization: Bearer <token>"
+// header. ok is false if the header is missing, uses another scheme, or
+// has no token.
+func (r *Request) BearerToken() (token string, ok bool) {
+	scheme, token, found := strings.Cut(r.Headers["Authorization"], " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	if token == "" || strings.ContainsAny(token, " \t") {
+		return "", false
+	}
+	return token, true
+}
+
+// MaxForwards returns the hop limit from a Max-Forwards header, which TRACE
+// and OPTIONS requests use to stop at a given proxy. ok is false if the
+// header is missing or isn't a non-negative integer. ReverseProxy forwards
+// such a request with n-1, and answers it itself at zero; handlers that
+// aren't proxies are the final recipient whatever the value.
+func (r *Request) MaxForwards() (n int, ok bool) {
+	n, err := strconv.Atoi(strings.TrimSpace(r.Headers["Max-Forwards"]))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// setTarget splits a request target into its path and query, so routing only sees the path.
+func (r *Request) setTarget(target string) {
+	r.Path, r.RawQuery, _ = strings.Cut(target, "?")
+	// A malformed pair is skipped; the rest of the query is still usable.
+	r.query, _ = url.ParseQuery(r.RawQuery)
+}
+
+// maxFormMemory is how much of a multipart form ParseForm keeps in memory.
+const maxFormMemory = 10 << 20
+
+// ParseForm decodes the body of a urlencoded or multipart form. Uploaded
+// files in a multipart form are skipped; only plain fields are returned.
+func (r *Request) ParseForm() (url.Values, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Headers["Content-Type"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Type: %v", err)
+	}
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		return url.ParseQuery(r.Body())
+	case "multipart/form-data":
+		reader := multipart.NewReader(r.BodyReader(), params["boundary"])
+		form, err := reader.ReadForm(maxFormMemory)
+		if err != nil {
+			return nil, err
+		}
+		defer form.RemoveAll()
+		return url.Values(form.Value), nil
+	default:
+		return nil, fmt.Errorf("unsupported form Content-Type %q", mediaType)
+	}
 }
 
 // ResponseWriter is an interface used by an HTTP handler to construct an HTTP response.
+// The body is buffered and sent with an exact Content-Length once the handler
+// returns, unless the handler calls Flush or writes more than fits in the buffer,
+// in which case the rest of the body is streamed using chunked encoding.
+//
+// Headers must be set before WriteHeader or the first Write. Setting one
+// afterwards has no effect and logs a warning.
 type ResponseWriter interface {
 	SetHeader(key, value string)
+	// AddHeader adds a value to a header, keeping those it has. Each value
+	// goes out on a line of its own, for headers such as Set-Cookie that
+	// can't be joined with commas.
+	AddHeader(key, value string)
 	WriteHeader(statusCode int)
 	Write(data []byte) (int, error)
+	Flush()
 	Status() int
+	// SetTrailer sets a trailer field, sent after the body. The response is
+	// chunked then, and the field must be announced up front in a Trailer
+	// header. Trailers are dropped if the client can't take chunking.
+	SetTrailer(key, value string)
+	// FirstWrite returns when the handler started its response, with its
+	// first WriteHeader or Write, or the zero time if it hasn't yet.
+	FirstWrite() time.Time
 }
 
+// bufferSize is how much of the body a response holds back before the headers
+// are forced out.
+const bufferSize = 4 << 10
+
+// response is safe for concurrent use: a handler may hand it to goroutines
+// that write parts of the body. Each Write lands whole, though the order of
+// writes from different goroutines is up to the handler to arrange.
 type response struct {
+	mu          sync.Mutex // Guards everything below; held by every exported method.
 	conn        net.Conn
+	w           *bufio.Writer // The connection's writer; flushed with the response.
 	headers     map[string]string
+	moreHeaders map[string][]string // Values after the first, from AddHeader.
 	statusCode  int
-	wroteHeader bool
+	wroteHeader bool   // The status code is final.
+	sentHeader  bool   // The status line and headers are on the wire.
+	chunked     bool   // The body is framed with chunked transfer encoding.
+	buf         []byte // Body held back until the headers are sent, or the next chunk.
+
+	contentLength int64 // Declared by the handler, or -1.
+	written       int64 // Body bytes accepted from the handler so far.
+	closeConn     bool  // The connection is closed after this response.
+	noChunking    bool  // The client doesn't understand chunked encoding (HTTP/1.0).
+	head          bool  // The request was HEAD: the headers go out as for GET, the body doesn't.
+
+	// defaultContentType is used when the handler didn't set a Content-Type.
+	defaultContentType string
+
+	// writeTimeout caps the time from sending the headers to the end of the
+	// body. Zero means no limit.
+	writeTimeout time.Duration
+
+	// firstWrite is when the handler started the response, see FirstWrite.
+	firstWrite time.Time
+
+	trailers map[string]string // Sent after the last chunk.
+
+	// err is the first error writing to the connection. The client is gone
+	// then, so every later write fails with it straight away.
+	err    error
+	cancel context.CancelFunc // Cancels the request's context.
 }
 
-func newResponse(conn net.Conn) *response {
+func newResponse(conn net.Conn, w *bufio.Writer) *response {
 	return &response{
 		conn:    conn,
+		w:       w,
 		headers: make(map[string]string),
 		statusCode: 200,
+		contentLength: -1,
 	}
 }
 
 func (rw *response) SetHeader(key, value string) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.wroteHeader {
+		log.Printf("Warning: header %q set after WriteHeader, ignoring it", key)
+		return
+	}
 	rw.headers[key] = value
+	delete(rw.moreHeaders, key)
 }
 
+func (rw *response) AddHeader(key, value string) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.wroteHeader {
+		log.Printf("Warning: header %q set after WriteHeader, ignoring it", key)
+		return
+	}
+	if _, ok := rw.headers[key]; !ok {
+		rw.headers[key] = value
+		return
+	}
+	if rw.moreHeaders == nil {
+		rw.moreHeaders = make(map[string][]string)
+	}
+	rw.moreHeaders[key] = append(rw.moreHeaders[key], value)
+}
+
+// Fixes the status code. Nothing is sent until the body is flushed or the handler returns.
 func (rw *response) WriteHeader(statusCode int) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.writeHeader(statusCode)
+}
+
+func (rw *response) writeHeader(statusCode int) {
 	if rw.wroteHeader {
 		return
 	}
+	rw.firstWrite = time.Now()
 	rw.statusCode = statusCode
-	statusText := StatusText(statusCode)
+	if _, ok := rw.headers["Content-Type"]; !ok && rw.defaultContentType != "" && bodyAllowed(statusCode) {
+		rw.headers["Content-Type"] = rw.defaultContentType
+	}
+	// A response without a body isn't held to a Content-Length; the header
+	// is dropped when it is sent.
+	if cl, ok := rw.headers["Content-Length"]; ok && bodyAllowed(statusCode) {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			log.Printf("Error: invalid Content-Length %q set by handler, ignoring it", cl)
+			delete(rw.headers, "Content-Length")
+		} else {
+			rw.contentLength = n
+		}
+	}
+	rw.wroteHeader = true
+}
+
+// Main function that writes to the client 
+func (rw *response) Write(data []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.writeData(data)
+}
+
+// writeData is Write for callers that hold rw.mu.
+func (rw *response) writeData(data []byte) (int, error) {
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	if !rw.wroteHeader {
+		rw.writeHeader(rw.statusCode)
+	}
+	if !bodyAllowed(rw.statusCode) {
+		return 0, ErrBodyNotAllowed
+	}
+	// Writing past a declared Content-Length would corrupt the framing of
+	// whatever follows on the connection, so the excess is dropped.
+	if rw.contentLength >= 0 && rw.written+int64(len(data)) > rw.contentLength {
+		log.Printf("Error: handler wrote more than its declared Content-Length of %d, truncating", rw.contentLength)
+		n, err := rw.write(data[:rw.contentLength-rw.written])
+		if err == nil {
+			err = ErrContentLength
+		} else {
+			rw.connFailed(err)
+		}
+		return n, err
+	}
+	n, err := rw.write(data)
+	if err != nil {
+		rw.connFailed(err)
+	}
+	return n, err
+}
 
+// connFailed records err from writing to the connection and cancels the
+// request's context, since nothing more can reach the client.
+func (rw *response) connFailed(err error) {
+	if rw.err == nil {
+		rw.err = err
+		if rw.cancel != nil {
+			rw.cancel()
+		}
+	}
+}
+
+func (rw *response) write(data []byte) (int, error) {
+	rw.written += int64(len(data))
+	if rw.head {
+		// Counted for the Content-Length, but the client isn't expecting
+		// the bytes and would read them as the next response.
+		return len(data), nil
+	}
+	// A chunked body is held back as well, so each flush makes one chunk
+	// rather than one per Write.
+	if !rw.sentHeader || rw.chunked {
+		rw.buf = append(rw.buf, data...)
+		if len(rw.buf) > bufferSize {
+			if err := rw.flush(); err != nil {
+				return 0, err
+			}
+		}
+		return len(data), nil
+	}
+	return rw.writeBody(data)
+}
+
+// Flush sends the headers and everything written so far to the client. If the
+// handler didn't set a Content-Length, the rest of the body is sent chunked.
+// Everything written between two flushes makes up one chunk.
+func (rw *response) Flush() {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.err != nil {
+		return
+	}
+	if err := rw.flush(); err != nil {
+		rw.connFailed(err)
+		log.Printf("Error flushing response: %v", err)
+	}
+}
+
+// writeChunk writes data and flushes it while holding rw.mu throughout, so
+// a concurrent Write can't slip into the chunk. See WriteChunk.
+func (rw *response) writeChunk(data []byte) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if _, err := rw.writeData(data); err != nil {
+		return err
+	}
+	if err := rw.flush(); err != nil {
+		rw.connFailed(err)
+		return err
+	}
+	return nil
+}
+
+func (rw *response) flush() error {
+	if !rw.wroteHeader {
+		rw.writeHeader(rw.statusCode)
+	}
+	if !rw.sentHeader {
+		if !bodyAllowed(rw.statusCode) {
+			delete(rw.headers, "Content-Length")
+		} else if _, ok := rw.headers["Content-Length"]; !ok {
+			if rw.noChunking {
+				// Without chunking, the end of the body is marked by closing the connection.
+				rw.closeConn = true
+			} else {
+				rw.chunked = true
+				rw.headers["Transfer-Encoding"] = "chunked"
+			}
+		}
+		if rw.closeConn {
+			rw.headers["Connection"] = "close"
+		}
+		if err := rw.sendHeader(); err != nil {
+			return err
+		}
+	}
+	buf := rw.buf
+	rw.buf = nil
+	if _, err := rw.writeBody(buf); err != nil {
+		return err
+	}
+	return rw.w.Flush()
+}
+
+func (rw *response) sendHeader() error {
+	var sb strings.Builder
 	// For status info
-	fmt.Fprintf(rw.conn, "HTTP/1.1 %d %s\r\n", rw.statusCode, statusText)
+	fmt.Fprintf(&sb, "HTTP/1.1 %d %s\r\n", rw.statusCode, StatusText(rw.statusCode))
 	// Next in line are the headers
 	for key, value := range rw.headers {
-		fmt.Fprintf(rw.conn, "%s: %s\r\n", key, value)
+		fmt.Fprintf(&sb, "%s: %s\r\n", key, value)
+		for _, more := range rw.moreHeaders[key] {
+			fmt.Fprintf(&sb, "%s: %s\r\n", key, more)
+		}
 	}
 	// Now the end of headers
-	fmt.Fprint(rw.conn, "\r\n")
-	rw.wroteHeader = true
+	sb.WriteString("\r\n")
+	rw.sentHeader = true
+	if rw.writeTimeout > 0 {
+		// A client draining the response too slowly makes the writes fail
+		// once the budget is used up, and the connection is dropped.
+		rw.conn.SetWriteDeadline(time.Now().Add(rw.writeTimeout))
+	}
+	_, err := io.WriteString(rw.w, sb.String())
+	return err
 }
 
-// Main function that writes to the client 
-func (rw *response) Write(data []byte) (int, error) {
-	if !rw.wroteHeader {
-		if _, ok := rw.headers["Content-Length"]; !ok {
-			rw.SetHeader("Content-Length", fmt.Sprintf("%d", len(data)))
+// writeBody sends data that follows the headers, wrapping it in a chunk if needed.
+func (rw *response) writeBody(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if !rw.chunked {
+		return rw.w.Write(data)
+	}
+	if _, err := fmt.Fprintf(rw.w, "%x\r\n", len(data)); err != nil {
+		return 0, err
+	}
+	n, err := rw.w.Write(data)
+	if err != nil {
+		return n, err
+	}
+	_, err = io.WriteString(rw.w, "\r\n")
+	return n, err
+}
+
+// finish completes the response after the handler has returned. A body that
+// is still fully buffered gets an exact Content-Length; a chunked body gets
+// its terminating chunk.
+func (rw *response) finish() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.err != nil {
+		return rw.err
+	}
+	if rw.contentLength >= 0 && rw.written < rw.contentLength && !rw.head {
+		// There's no way to make up the missing bytes; closing the connection
+		// is the only way to tell the client the body is incomplete.
+		log.Printf("Error: handler wrote %d bytes but declared a Content-Length of %d, closing connection", rw.written, rw.contentLength)
+		rw.closeConn = true
+	}
+	if !rw.sentHeader {
+		// With trailers announced the body stays chunked, as they can only
+		// follow the last chunk.
+		_, ok := rw.headers["Content-Length"]
+		if !ok && bodyAllowed(rw.statusCode) && (rw.headers["Trailer"] == "" || rw.noChunking) {
+			// Nothing was buffered for HEAD, but the count is what GET would send.
+			rw.headers["Content-Length"] = strconv.FormatInt(rw.written, 10)
+		}
+		if err := rw.flush(); err != nil {
+			return err
+		}
+	}
+	if rw.chunked && !rw.head {
+		buf := rw.buf
+		rw.buf = nil
+		if _, err := rw.writeBody(buf); err != nil {
+			return err
+		}
+		var sb strings.Builder
+		sb.WriteString("0\r\n")
+		for key, value := range rw.trailers {
+			fmt.Fprintf(&sb, "%s: %s\r\n", key, value)
+		}
+		sb.WriteString("\r\n")
+		if _, err := io.WriteString(rw.w, sb.String()); err != nil {
+			return err
 		}
-		rw.WriteHeader(rw.statusCode)
 	}
-	return rw.conn.Write(data)
+	return rw.w.Flush()
 }
 
 func (rw *response) Status() int {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
 	return rw.statusCode
 }
 
-func parseRequest(conn net.Conn) (*Request, error) {
-	reader := bufio.NewReader(conn)
-	requestLine, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
+func (rw *response) SetTrailer(key, value string) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.trailers == nil {
+		rw.trailers = make(map[string]string)
+	}
+	rw.trailers[key] = value
+}
+
+func (rw *response) FirstWrite() time.Time {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.firstWrite
+}
+
+// ErrContentLength is returned by Write when the body exceeds the declared Content-Length.
+var ErrContentLength = errors.New("wrote more than the declared Content-Length")
+
+// ErrBodyNotAllowed is returned by Write when the status code doesn't permit a body.
+var ErrBodyNotAllowed = errors.New("response status does not allow a body")
+
+// bodyAllowed reports whether a response with the given status may have a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != 204 && status != 304
+}
+
+// requestError is returned by parseRequest when a request is rejected for a
+// reason that maps to a specific status code rather than a plain 400.
+type requestError struct {
+	code int
+	msg  string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+// requestLimits bounds how much of a request parseRequest is willing to accept.
+// A zero value disables the corresponding check.
+type requestLimits struct {
+	maxHeaderBytes      int // The request line and headers together.
+	maxHeaderValueBytes int
+	maxBodyBytes        int64
+}
+
+// errLineTooLong is returned by readLine for a line over its limit.
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads a line like reader.ReadString('\n'), but gives up with
+// errLineTooLong as soon as the line is longer than max bytes, so a huge
+// line is never held in memory. A negative max means no limit.
+func readLine(reader *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if max >= 0 && len(line)+len(chunk) > max {
+			return "", errLineTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			if line == nil {
+				return string(chunk), err
+			}
+			return string(append(line, chunk...)), err
+		}
+		line = append(line, chunk...)
+	}
+}
+
+// maxLeadingEmptyLines is how many empty lines parseRequest skips before a request line.
+const maxLeadingEmptyLines = 4
+
+// parseRequest reads a request line and headers from reader, which must be
+// the connection's only reader since it may buffer past the headers.
+func parseRequest(conn net.Conn, reader *bufio.Reader, limits requestLimits) (*Request, error) {
+	// RFC 7230 asks servers to ignore empty lines before the request line
+	// (some clients send a stray CRLF after a POST body), but only a few.
+	// Every line counts against limits.maxHeaderBytes, and is read only as
+	// far as what is left of it.
+	headerBytes := 0
+	nextLine := func() (string, error) {
+		max := -1
+		if limits.maxHeaderBytes > 0 {
+			max = limits.maxHeaderBytes - headerBytes
+		}
+		line, err := readLine(reader, max)
+		headerBytes += len(line)
+		return line, err
+	}
+
+	var requestLine string
+	for skipped := 0; ; skipped++ {
+		line, err := nextLine()
+		if err == errLineTooLong {
+			return nil, &requestError{414, fmt.Sprintf("request line exceeds %d bytes", limits.maxHeaderBytes)}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimRight(line, "\r\n") != "" {
+			requestLine = line
+			break
+		}
+		if skipped == maxLeadingEmptyLines {
+			return nil, fmt.Errorf("too many empty lines before the request line")
+		}
 	}
 	parts := strings.Split(strings.TrimSpace(requestLine), " ")
 	if len(parts) != 3 {
@@ -98,43 +655,236 @@ func parseRequest(conn net.Conn) (*Request, error) {
 		Method: parts[0], Path: parts[1], Version: parts[2],
 		Headers: make(map[string]string), Conn: conn,
 	}
+	req.setTarget(parts[1])
 
 	for {
-		line, err := reader.ReadString('\n')
+		line, err := nextLine()
+		if err == errLineTooLong {
+			return nil, &requestError{431, fmt.Sprintf("request headers exceed %d bytes", limits.maxHeaderBytes)}
+		}
 		if err != nil { return nil, err }
 		line = strings.TrimSpace(line)
 		if line == "" { break }
-		headerParts := strings.SplitN(line, ":", 2)
-		if len(headerParts) != 2 { continue }
-		req.Headers[strings.TrimSpace(headerParts[0])] = strings.TrimSpace(headerParts[1])
+		// Cut rather than SplitN: the name and value are just substrings of
+		// line, so a header costs no allocation beyond reading it.
+		name, value, ok := strings.Cut(line, ":")
+		if !ok { continue }
+		// Proxies disagree about "Name :", so it could smuggle a header past one.
+		if strings.TrimRight(name, " \t") != name {
+			return nil, fmt.Errorf("whitespace before the colon in header %q", name)
+		}
+		// Handlers look headers up by their canonical spelling, as with h2c.
+		name, value = textproto.CanonicalMIMEHeaderKey(strings.TrimLeft(name, " \t")), strings.TrimSpace(value)
+		if limits.maxHeaderValueBytes > 0 && len(value) > limits.maxHeaderValueBytes {
+			return nil, &requestError{431, fmt.Sprintf("header %q exceeds %d bytes", name, limits.maxHeaderValueBytes)}
+		}
+		if prev, ok := req.Headers[name]; ok {
+			if name == "Content-Length" && prev != value {
+				return nil, fmt.Errorf("conflicting Content-Length values %q and %q", prev, value)
+			}
+			if name == "Transfer-Encoding" {
+				return nil, fmt.Errorf("repeated Transfer-Encoding")
+			}
+		}
+		req.Headers[name] = value
+	}
+
+	// Where the body ends has to be beyond doubt, or a proxy in front of the
+	// server could see a different request boundary than we do.
+	if te, ok := req.Headers["Transfer-Encoding"]; ok {
+		if _, ok := req.Headers["Content-Length"]; ok {
+			return nil, fmt.Errorf("both Transfer-Encoding and Content-Length")
+		}
+		if !strings.EqualFold(te, "chunked") {
+			return nil, fmt.Errorf("unsupported Transfer-Encoding %q", te)
+		}
 	}
 
-	if contentLengthStr, ok := req.Headers["Content-Length"]; ok {
-		length, err := strconv.Atoi(contentLengthStr)
-		if err != nil { return nil, fmt.Errorf("invalid Content-Length: %v", err) }
-		
+	// The body isn't read here. It is left on the connection and streamed to
+	// the handler when it asks for it, with read deadlines of its own.
+	timed := func(r io.Reader) io.Reader {
+		if conn == nil {
+			return r
+		}
+		return &idleTimeoutReader{conn: conn, r: r}
+	}
+	if strings.EqualFold(req.Headers["Transfer-Encoding"], "chunked") {
+		req.Trailers = make(map[string]string)
+		req.body = &countingReader{r: timed(&chunkedReader{r: reader, trailers: req.Trailers}), n: &req.bodyRead}
+		if limits.maxBodyBytes > 0 {
+			req.body = &limitedBody{r: req.body, n: limits.maxBodyBytes}
+		}
+	} else if contentLengthStr, ok := req.Headers["Content-Length"]; ok {
+		length, err := strconv.ParseInt(contentLengthStr, 10, 64)
+		if err != nil || length < 0 { return nil, fmt.Errorf("invalid Content-Length: %q", contentLengthStr) }
+		if limits.maxBodyBytes > 0 && length > limits.maxBodyBytes {
+			return nil, &requestError{413, fmt.Sprintf("declared body of %d bytes exceeds %d", length, limits.maxBodyBytes)}
+		}
 		if length > 0 {
-			body := make([]byte, length)
-			_, err := reader.Read(body)
-			if err != nil { return nil, err }
-			req.Body = string(body)
+			req.body = io.LimitReader(timed(reader), length)
 		}
 	}
+
+	// With "Expect: 100-continue" the client holds the body back until it is
+	// told to go ahead. That only happens once the handler starts reading, so
+	// a request rejected up front (e.g. a failed auth check) is never uploaded.
+	if req.body != nil && req.Version == "HTTP/1.1" && strings.EqualFold(req.Headers["Expect"], "100-continue") {
+		req.body = &continueReader{r: req.body, conn: conn}
+	}
 	return req, nil
 }
 
+// TimeFormat is the format of dates in HTTP headers (RFC 1123 in GMT).
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// httpDateFormats are the three date formats HTTP/1.1 recipients must accept.
+var httpDateFormats = []string{
+	TimeFormat,
+	"Monday, 02-Jan-06 15:04:05 GMT", // RFC 850, obsolete.
+	"Mon Jan _2 15:04:05 2006",       // ANSI C asctime(), obsolete.
+}
+
+// ParseHTTPDate parses a date header value in any of the formats allowed by
+// HTTP: RFC 1123, RFC 850 and ANSI C asctime. The result is in UTC.
+func ParseHTTPDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range httpDateFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid HTTP date %q", s)
+}
+
+// notModified reports whether the client's If-Modified-Since shows that its
+// copy of a resource last changed at modTime is still current. Only GET and
+// HEAD requests are conditional.
+func notModified(r *Request, modTime time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	since, err := ParseHTTPDate(r.Headers["If-Modified-Since"])
+	if err != nil {
+		return false
+	}
+	// Header dates only have second precision.
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// etagMatches reports whether the client's If-None-Match lists etag (or is
+// "*"), meaning its cached copy is current. Weak validators compare equal to
+// their strong counterparts, as the weak comparison for GET requires.
+func etagMatches(r *Request, etag string) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	for _, candidate := range strings.Split(r.Headers["If-None-Match"], ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
 func StatusText(code int) string {
 	switch code {
 	case 200: return "OK"
+	case 204: return "No Content"
+	case 301: return "Moved Permanently"
+	case 302: return "Found"
+	case 304: return "Not Modified"
+	case 308: return "Permanent Redirect"
 	case 400: return "Bad Request"
+	case 401: return "Unauthorized"
+	case 403: return "Forbidden"
 	case 404: return "Not Found"
 	case 405: return "Method Not Allowed"
+	case 406: return "Not Acceptable"
+	case 408: return "Request Timeout"
+	case 413: return "Payload Too Large"
+	case 414: return "URI Too Long"
+	case 415: return "Unsupported Media Type"
+	case 421: return "Misdirected Request"
+	case 422: return "Unprocessable Entity"
+	case 429: return "Too Many Requests"
+	case 431: return "Request Header Fields Too Large"
 	case 500: return "Internal Server Error"
+	case 502: return "Bad Gateway"
+	case 503: return "Service Unavailable"
+	case 504: return "Gateway Timeout"
 	default: return ""
 	}
 }
 
-func httpError(w ResponseWriter, code int) {
+// Redirect sends a redirect to url with the given 3xx status code.
+func Redirect(w ResponseWriter, r *Request, url string, code int) {
+	w.SetHeader("Location", url)
+	w.SetHeader("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "%d %s: %s", code, StatusText(code), url)
+}
+
+// statusWriter pins the status code of a response, so an error page handler
+// can set headers and write a body without having to know the status.
+type statusWriter struct {
+	ResponseWriter
+	code int
+}
+
+func (sw *statusWriter) WriteHeader(int) {
+	sw.ResponseWriter.WriteHeader(sw.code)
+}
+
+func (sw *statusWriter) Write(data []byte) (int, error) {
+	sw.ResponseWriter.WriteHeader(sw.code)
+	return sw.ResponseWriter.Write(data)
+}
+
+func (sw *statusWriter) Flush() {
+	sw.ResponseWriter.WriteHeader(sw.code)
+	sw.ResponseWriter.Flush()
+}
+
+// WriteChunk writes data and flushes it, so that on a chunked response it
+// goes out as exactly one chunk, e.g. one per logical record of a stream.
+// Writes since the previous flush are sent along in the same chunk. Empty
+// data sends nothing, since an empty chunk would end the body. On the
+// server's own response writer no concurrent Write can get into the chunk;
+// through a wrapping writer (middleware) it is a plain Write and Flush.
+func WriteChunk(w ResponseWriter, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if rw, ok := w.(*response); ok {
+		return rw.writeChunk(data)
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// NoContent sends an empty 204 response. It has no body and no Content-Length.
+func NoContent(w ResponseWriter) {
+	w.WriteHeader(204)
+}
+
+// httpError writes an error response, using the page registered for code with
+// Server.SetErrorPage if there is one and a plain-text default (or problem
+// details, see Server.ProblemDetails) otherwise.
+func httpError(w ResponseWriter, r *Request, code int) {
+	if r != nil && r.server != nil {
+		if page, ok := r.server.errorPages[code]; ok {
+			page(&statusWriter{ResponseWriter: w, code: code}, r)
+			return
+		}
+	}
+	if r != nil && r.server != nil && r.server.ProblemDetails {
+		WriteProblem(w, code, StatusText(code), "")
+		return
+	}
 	w.SetHeader("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(code)
 	fmt.Fprintf(w, "%d %s", code, StatusText(code))
@@ -0,0 +1,808 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const benchRequest = "GET /search?q=go&page=2 HTTP/1.1\r\n" +
+	"Host: example.com\r\n" +
+	"User-Agent: Mozilla/5.0 (X11; Linux x86_64)\r\n" +
+	"Accept: text/html,application/xhtml+xml\r\n" +
+	"Accept-Encoding: gzip, br\r\n" +
+	"Accept-Language: en-US,en;q=0.9\r\n" +
+	"Cookie: session=abc123\r\n" +
+	"Referer: https://example.com/\r\n" +
+	"Connection: keep-alive\r\n" +
+	"\r\n"
+
+func BenchmarkParseRequest(b *testing.B) {
+	src := strings.NewReader(benchRequest)
+	reader := bufio.NewReader(src)
+	b.ReportAllocs()
+	for b.Loop() {
+		src.Reset(benchRequest)
+		reader.Reset(src)
+		if _, err := parseRequest(nil, reader, requestLimits{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseRequestHeaders(t *testing.T) {
+	raw := "GET /a HTTP/1.1\r\nHost: example.com\r\nX-Url: http://x:8080/p\r\nno colon here\r\n  x-lower-case:  value  \r\n\r\n" +
+		"GET /b HTTP/1.1\r\nHost: other.example\r\n\r\n"
+	reader := bufio.NewReader(strings.NewReader(raw))
+
+	first, err := parseRequest(nil, reader, requestLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"Host": "example.com", "X-Url": "http://x:8080/p", "X-Lower-Case": "value"}
+	if len(first.Headers) != len(want) {
+		t.Errorf("first request headers = %q, want %q", first.Headers, want)
+	}
+	for name, value := range want {
+		if first.Headers[name] != value {
+			t.Errorf("first request %s = %q, want %q", name, first.Headers[name], value)
+		}
+	}
+
+	// The next request on the connection starts with headers of its own.
+	second, err := parseRequest(nil, reader, requestLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second.Headers) != 1 || second.Headers["Host"] != "other.example" {
+		t.Errorf("second request headers = %q, want only Host", second.Headers)
+	}
+	if first.Headers["Host"] != "example.com" {
+		t.Errorf("first request Host changed to %q", first.Headers["Host"])
+	}
+}
+
+func TestParseRequestRejectsAmbiguousFraming(t *testing.T) {
+	for name, headers := range map[string]string{
+		"space before colon":  "Content-Length : 5\r\n",
+		"length and encoding": "Content-Length: 5\r\nTransfer-Encoding: chunked\r\n",
+		"unknown encoding":    "Transfer-Encoding: gzip, chunked\r\n",
+		"repeated encoding":   "Transfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n",
+		"conflicting lengths": "Content-Length: 5\r\ncontent-length: 6\r\n",
+	} {
+		raw := "POST / HTTP/1.1\r\nHost: example.com\r\n" + headers + "\r\nhello"
+		if _, err := parseRequest(nil, bufio.NewReader(strings.NewReader(raw)), requestLimits{}); err == nil {
+			t.Errorf("%s: parsed without error", name)
+		}
+	}
+
+	// The same length twice is harmless, and the server answers the rest
+	// with 400 and a closed connection.
+	raw := "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello"
+	if _, err := parseRequest(nil, bufio.NewReader(strings.NewReader(raw)), requestLimits{}); err != nil {
+		t.Errorf("repeated equal Content-Length: %v", err)
+	}
+	s := NewServer("")
+	s.Handle("POST", "/", func(w ResponseWriter, r *Request) { w.Write([]byte("ok")) })
+	addr := startServer(t, s)
+	got := rawRequest(t, addr, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	if !strings.HasPrefix(got, "HTTP/1.1 400 ") || strings.Count(got, "HTTP/1.1 ") != 1 {
+		t.Errorf("response = %q, want a lone 400", got)
+	}
+}
+
+func TestHeadersNotSharedOnKeepAlive(t *testing.T) {
+	s := NewServer("")
+	kept := make(chan map[string]string, 2)
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		kept <- r.Headers
+		w.Write([]byte(r.Headers["X-Token"]))
+	})
+	addr := startServer(t, s)
+
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nX-Token: first\r\n\r\n"+
+		"GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	br := bufio.NewReader(strings.NewReader(resp))
+	if _, body := readResponse(t, br); body != "first" {
+		t.Errorf("first response = %q, want %q", body, "first")
+	}
+	if _, body := readResponse(t, br); body != "" {
+		t.Errorf("second response = %q, want no X-Token from the first request", body)
+	}
+	// A map a handler held on to isn't reused for the next request.
+	if first, second := <-kept, <-kept; first["X-Token"] != "first" || first["Connection"] != "" || len(second) != 2 {
+		t.Errorf("headers seen = %q then %q", first, second)
+	}
+}
+
+func TestMaxHeaderValueBytes(t *testing.T) {
+	s := NewServer("")
+	s.MaxHeaderValueBytes = 100
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("ok"))
+	})
+	addr := startServer(t, s)
+
+	tests := []struct {
+		name   string
+		cookie string
+		want   string
+	}{
+		{"at the limit", strings.Repeat("c", 100), "HTTP/1.1 200 "},
+		{"one oversized value", strings.Repeat("c", 101), "HTTP/1.1 431 "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\nCookie: "+tt.cookie+"\r\n\r\n")
+			if !strings.HasPrefix(resp, tt.want) {
+				t.Errorf("response = %q, want status line %q", resp, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRequestHeaderValueLimit(t *testing.T) {
+	raw := "GET / HTTP/1.1\r\nHost: x\r\nX-Big: " + strings.Repeat("v", 11) + "\r\n\r\n"
+	_, err := parseRequest(nil, bufio.NewReader(strings.NewReader(raw)), requestLimits{maxHeaderValueBytes: 10})
+	reqErr, ok := err.(*requestError)
+	if !ok || reqErr.code != 431 {
+		t.Fatalf("err = %v, want a 431 requestError", err)
+	}
+	if _, err := parseRequest(nil, bufio.NewReader(strings.NewReader(raw)), requestLimits{}); err != nil {
+		t.Errorf("without a limit: err = %v", err)
+	}
+}
+
+// endlessReader never runs out of the byte b.
+type endlessReader byte
+
+func (r endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestParseRequestHeaderBytesLimit(t *testing.T) {
+	limits := requestLimits{maxHeaderBytes: 64 << 10}
+	tests := []struct {
+		name string
+		r    io.Reader
+		code int
+	}{
+		// Neither ends, so the limit is all that stops the read.
+		{"endless request line", io.MultiReader(strings.NewReader("GET /"), endlessReader('a')), 414},
+		{"endless header", io.MultiReader(strings.NewReader("GET / HTTP/1.1\r\nX-Big: "), endlessReader('v')), 431},
+		{"too many headers", io.MultiReader(strings.NewReader("GET / HTTP/1.1\r\n"), strings.NewReader(strings.Repeat("X-A: b\r\n", 10000))), 431},
+	}
+	for _, tt := range tests {
+		_, err := parseRequest(nil, bufio.NewReader(tt.r), limits)
+		if reqErr, ok := err.(*requestError); !ok || reqErr.code != tt.code {
+			t.Errorf("%s: err = %v, want a %d requestError", tt.name, err, tt.code)
+		}
+	}
+
+	raw := "GET / HTTP/1.1\r\nHost: x\r\n\r\n"
+	if _, err := parseRequest(nil, bufio.NewReader(strings.NewReader(raw)), requestLimits{maxHeaderBytes: len(raw)}); err != nil {
+		t.Errorf("headers of exactly the limit: err = %v", err)
+	}
+	if _, err := parseRequest(nil, bufio.NewReader(strings.NewReader(raw)), requestLimits{maxHeaderBytes: len(raw) - 1}); err == nil {
+		t.Errorf("headers one byte over the limit: err = nil")
+	}
+}
+
+func TestFlushSendsPartialResponse(t *testing.T) {
+	s := NewServer("")
+	release := make(chan struct{})
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("<head></head>"))
+		w.Flush()
+		// The rest of the page takes a while.
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte("<body></body>"))
+	})
+	addr := startServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("Transfer-Encoding = %q, want chunked", resp.TransferEncoding)
+	}
+
+	// The first part has to arrive while the handler is still waiting.
+	head := make([]byte, len("<head></head>"))
+	if _, err := io.ReadFull(resp.Body, head); err != nil {
+		t.Fatalf("reading the flushed part: %v", err)
+	}
+	if string(head) != "<head></head>" {
+		t.Errorf("first part = %q", head)
+	}
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "<body></body>" {
+		t.Errorf("second part = %q", rest)
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	s := NewServer("")
+	s.DefaultContentType = "application/json"
+	s.Handle("GET", "/default", func(w ResponseWriter, r *Request) {
+		w.Write([]byte(`{}`))
+	})
+	s.Handle("GET", "/own", func(w ResponseWriter, r *Request) {
+		w.SetHeader("Content-Type", "text/csv")
+		w.Write([]byte("a,b"))
+	})
+	addr := startServer(t, s)
+
+	for path, want := range map[string]string{"/default": "application/json", "/own": "text/csv"} {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Content-Type"); got != want {
+			t.Errorf("%s: Content-Type = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestNoDefaultContentType(t *testing.T) {
+	s := NewServer("")
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("data"))
+	})
+	addr := startServer(t, s)
+
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if strings.Contains(resp, "Content-Type") {
+		t.Errorf("response without a default has a Content-Type: %q", resp)
+	}
+}
+
+func TestSetHeaderAfterWriteHeader(t *testing.T) {
+	logs := captureLog(t)
+	s := NewServer("")
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		w.SetHeader("X-Early", "1")
+		w.WriteHeader(200)
+		w.SetHeader("X-Late", "1")
+		w.Write([]byte("ok"))
+	})
+	addr := startServer(t, s)
+
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if !strings.Contains(resp, "X-Early: 1") {
+		t.Errorf("header set in time is missing: %q", resp)
+	}
+	if strings.Contains(resp, "X-Late") {
+		t.Errorf("header set after WriteHeader was sent: %q", resp)
+	}
+	if !strings.Contains(logs.String(), `Warning: header "X-Late" set after WriteHeader`) {
+		t.Errorf("no warning logged, log: %q", logs.String())
+	}
+}
+
+func TestNoContent(t *testing.T) {
+	s := NewServer("")
+	s.DefaultContentType = "text/plain"
+	writeErr := make(chan error, 1)
+	s.Handle("DELETE", "/item", func(w ResponseWriter, r *Request) {
+		w.SetHeader("Content-Length", "10")
+		NoContent(w)
+		_, err := w.Write([]byte("ignored"))
+		writeErr <- err
+	})
+	s.Handle("GET", "/next", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("next"))
+	})
+	addr := startServer(t, s)
+
+	// A second request on the connection only parses if the 204 has no body.
+	resp := rawRequest(t, addr, "DELETE /item HTTP/1.1\r\nHost: x\r\n\r\nGET /next HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	first, rest, _ := strings.Cut(resp, "\r\n\r\n")
+	if !strings.HasPrefix(first+"\r\n", "HTTP/1.1 204 No Content\r\n") {
+		t.Errorf("status line of %q, want 204 No Content", first)
+	}
+	if strings.Contains(first, "Content-Length") || strings.Contains(first, "Transfer-Encoding") {
+		t.Errorf("204 has framing headers: %q", first)
+	}
+	if !strings.HasPrefix(rest, "HTTP/1.1 200 ") || !strings.HasSuffix(rest, "next") {
+		t.Errorf("after the 204 came %q, want the next response", rest)
+	}
+	if err := <-writeErr; err != ErrBodyNotAllowed {
+		t.Errorf("Write after NoContent: err = %v, want ErrBodyNotAllowed", err)
+	}
+}
+
+func TestHeadResponse(t *testing.T) {
+	s := NewServer("")
+	s.Handle("HEAD", "/page", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("hello"))
+	})
+	s.Handle("HEAD", "/declared", func(w ResponseWriter, r *Request) {
+		w.SetHeader("Content-Length", "20")
+	})
+	s.Handle("GET", "/next", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("next"))
+	})
+	addr := startServer(t, s)
+
+	// Each HEAD response announces the body GET would have, but sends none,
+	// so the responses after it are still read correctly.
+	resp := rawRequest(t, addr, "HEAD /page HTTP/1.1\r\nHost: x\r\n\r\nHEAD /declared HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"GET /next HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	br := bufio.NewReader(strings.NewReader(resp))
+	for _, want := range []string{"5", "20"} {
+		res, err := http.ReadResponse(br, &http.Request{Method: "HEAD"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Header.Get("Content-Length"); res.StatusCode != 200 || got != want {
+			t.Errorf("HEAD response %d with Content-Length %q, want 200 with %q", res.StatusCode, got, want)
+		}
+	}
+	if _, body := readResponse(t, br); body != "next" {
+		t.Errorf("after the HEAD responses came %q, want %q", body, "next")
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string // Empty means no Authorization header.
+		token  string
+		ok     bool
+	}{
+		{"valid", "Bearer abc.def.ghi", "abc.def.ghi", true},
+		{"scheme is case-insensitive", "bearer abc", "abc", true},
+		{"missing", "", "", false},
+		{"basic scheme", "Basic dXNlcjpwYXNz", "", false},
+		{"no token", "Bearer ", "", false},
+		{"space in token", "Bearer a b", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.header != "" {
+				headers["Authorization"] = tt.header
+			}
+			token, ok := newTestRequest("GET", "/", headers, "").BearerToken()
+			if token != tt.token || ok != tt.ok {
+				t.Errorf("BearerToken() = %q, %v; want %q, %v", token, ok, tt.token, tt.ok)
+			}
+		})
+	}
+}
+
+func TestDeclaredContentLength(t *testing.T) {
+	captureLog(t)
+	s := NewServer("")
+	writeErr := make(chan error, 1)
+	s.Handle("GET", "/over", func(w ResponseWriter, r *Request) {
+		w.SetHeader("Content-Length", "5")
+		_, err := w.Write([]byte("hello, this is too long"))
+		writeErr <- err
+	})
+	s.Handle("GET", "/under", func(w ResponseWriter, r *Request) {
+		w.SetHeader("Content-Length", "20")
+		w.Write([]byte("short"))
+	})
+	s.Handle("GET", "/next", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("next"))
+	})
+	addr := startServer(t, s)
+
+	t.Run("over-write", func(t *testing.T) {
+		resp := rawRequest(t, addr, "GET /over HTTP/1.1\r\nHost: x\r\n\r\nGET /next HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		br := bufio.NewReader(strings.NewReader(resp))
+		if _, body := readResponse(t, br); body != "hello" {
+			t.Errorf("body = %q, want it truncated to %q", body, "hello")
+		}
+		// The connection is still in sync for the next response.
+		if _, body := readResponse(t, br); body != "next" {
+			t.Errorf("next body = %q, want %q", body, "next")
+		}
+		if err := <-writeErr; err != ErrContentLength {
+			t.Errorf("Write err = %v, want ErrContentLength", err)
+		}
+	})
+
+	t.Run("under-write", func(t *testing.T) {
+		// The server closes the connection instead of answering the second
+		// request, so the client can tell the first body is incomplete.
+		resp := rawRequest(t, addr, "GET /under HTTP/1.1\r\nHost: x\r\n\r\nGET /next HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		head, body, _ := strings.Cut(resp, "\r\n\r\n")
+		if !strings.Contains(head, "Content-Length: 20") || body != "short" {
+			t.Errorf("response = %q, want the declared length and the short body, then EOF", resp)
+		}
+	})
+}
+
+func TestParseHTTPDate(t *testing.T) {
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"RFC 1123", "Sun, 06 Nov 1994 08:49:37 GMT", true},
+		{"RFC 850", "Sunday, 06-Nov-94 08:49:37 GMT", true},
+		{"asctime", "Sun Nov  6 08:49:37 1994", true},
+		{"surrounding space", "  Sun, 06 Nov 1994 08:49:37 GMT ", true},
+		{"empty", "", false},
+		{"ISO 8601", "1994-11-06T08:49:37Z", false},
+		{"garbage", "yesterday", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseHTTPDate(tt.value)
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("ParseHTTPDate(%q) = %v, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil || !got.Equal(want) || got.Location() != time.UTC {
+				t.Errorf("ParseHTTPDate(%q) = %v, %v; want %v", tt.value, got, err, want)
+			}
+		})
+	}
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	modTime := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	for _, since := range []string{
+		"Sun, 06 Nov 1994 08:49:37 GMT",
+		"Sunday, 06-Nov-94 08:49:37 GMT",
+		"Sun Nov  6 08:49:37 1994",
+	} {
+		rec := newResponseRecorder()
+		r := newTestRequest("GET", "/", map[string]string{"If-Modified-Since": since}, "")
+		ServeCachedContent(rec, r, []byte("page"), "text/plain", modTime)
+		if res := rec.result(); res.Status != 304 {
+			t.Errorf("If-Modified-Since %q: status = %d, want 304", since, res.Status)
+		}
+	}
+}
+
+func TestParseRequestLeadingEmptyLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		leading string
+		ok      bool
+	}{
+		{"none", "", true},
+		{"one CRLF", "\r\n", true},
+		{"bare LF", "\n", true},
+		{"at the limit", strings.Repeat("\r\n", maxLeadingEmptyLines), true},
+		{"over the limit", strings.Repeat("\r\n", maxLeadingEmptyLines+1), false},
+		{"many", strings.Repeat("\r\n", 1000), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.leading + "GET /x HTTP/1.1\r\nHost: a\r\n\r\n"))
+			req, err := parseRequest(nil, reader, requestLimits{})
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("parsed %s %s, want an error", req.Method, req.Path)
+				}
+				return
+			}
+			if err != nil || req.Method != "GET" || req.Path != "/x" {
+				t.Errorf("parseRequest = %v, %v", req, err)
+			}
+		})
+	}
+
+	s := NewServer("")
+	s.Handle("GET", "/x", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("x"))
+	})
+	addr := startServer(t, s)
+	if resp := rawRequest(t, addr, "\r\nGET /x HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n"); !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+		t.Errorf("one empty line: response = %q, want 200", resp)
+	}
+	if resp := rawRequest(t, addr, strings.Repeat("\r\n", 100)+"GET /x HTTP/1.1\r\nHost: a\r\n\r\n"); !strings.HasPrefix(resp, "HTTP/1.1 400 ") {
+		t.Errorf("many empty lines: response = %q, want 400", resp)
+	}
+}
+
+// readChunks reads a chunked body off br and returns its chunks as framed
+// on the wire.
+func readChunks(t *testing.T, br *bufio.Reader) []string {
+	t.Helper()
+	var chunks []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := strconv.ParseInt(strings.TrimRight(line, "\r\n"), 16, 64)
+		if err != nil {
+			t.Fatalf("chunk size line %q: %v", line, err)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(br, data); err != nil {
+			t.Fatal(err)
+		}
+		if size == 0 {
+			return chunks
+		}
+		chunks = append(chunks, string(data[:size]))
+	}
+}
+
+// readChunkedResponse sends raw to addr and returns the chunks of the response body.
+func readChunkedResponse(t *testing.T, addr, raw string) []string {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(rawRequest(t, addr, raw)))
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		if strings.HasPrefix(line, "Content-Length:") {
+			t.Fatalf("response isn't chunked: %q", line)
+		}
+	}
+	return readChunks(t, br)
+}
+
+func TestWriteChunk(t *testing.T) {
+	s := NewServer("")
+	s.Handle("GET", "/records", func(w ResponseWriter, r *Request) {
+		for _, record := range []string{"one", "two", "three"} {
+			if err := WriteChunk(w, []byte(record)); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	s.Handle("GET", "/flushes", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("a"))
+		w.Write([]byte("b"))
+		w.Flush()
+		w.Write([]byte("c"))
+		w.Flush()
+	})
+	addr := startServer(t, s)
+
+	chunks := readChunkedResponse(t, addr, "GET /records HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if strings.Join(chunks, "|") != "one|two|three" {
+		t.Errorf("chunks = %q, want one per WriteChunk", chunks)
+	}
+	chunks = readChunkedResponse(t, addr, "GET /flushes HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if strings.Join(chunks, "|") != "ab|c" {
+		t.Errorf("chunks = %q, want one per Flush", chunks)
+	}
+}
+
+func TestWriteChunkConcurrentWrite(t *testing.T) {
+	s := NewServer("")
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 500; i++ {
+				w.Write([]byte("-"))
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			WriteChunk(w, []byte(fmt.Sprintf("[record %d]", i)))
+		}
+		<-done
+	})
+	addr := startServer(t, s)
+
+	chunks := readChunkedResponse(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	records := 0
+	for _, chunk := range chunks {
+		// Other writes may come before a record in its chunk, but never
+		// inside it or after it.
+		chunk = strings.TrimLeft(chunk, "-")
+		if chunk == "" {
+			continue
+		}
+		want := fmt.Sprintf("[record %d]", records)
+		if chunk != want {
+			t.Fatalf("chunk ends in %q, want %q", chunk, want)
+		}
+		records++
+	}
+	if records != 100 {
+		t.Errorf("got %d records, want 100", records)
+	}
+}
+
+// TestConcurrentWrites is meant to be run with -race.
+func TestConcurrentWrites(t *testing.T) {
+	const writes, size = 200, 1000 // Enough to go past the response buffer.
+	s := NewServer("")
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		var wg sync.WaitGroup
+		for _, b := range []byte("AB") {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.SetHeader("X-Writer-"+string(b), "1")
+				w.WriteHeader(200)
+				block := bytes.Repeat([]byte{b}, size)
+				for i := 0; i < writes; i++ {
+					w.Write(block)
+				}
+				w.Flush()
+			}()
+		}
+		wg.Wait()
+	})
+	addr := startServer(t, s)
+
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	res, body := readResponse(t, bufio.NewReader(strings.NewReader(resp)))
+	if res.StatusCode != 200 || len(body) != 2*writes*size {
+		t.Fatalf("response = %d with %d bytes, want 200 with %d", res.StatusCode, len(body), 2*writes*size)
+	}
+	// Writes may interleave, but each one arrives in one piece.
+	for i := 0; i < len(body); i += size {
+		if block := body[i : i+size]; strings.Count(block, block[:1]) != size {
+			t.Fatalf("block at %d mixes writes: %q", i, block)
+		}
+	}
+}
+
+func TestRawQuery(t *testing.T) {
+	tests := []struct {
+		target, path, rawQuery string
+	}{
+		{"/search?q=a+b&x=%2F%20", "/search", "q=a+b&x=%2F%20"},
+		{"/search?q=caf%C3%A9&q=2&;bad", "/search", "q=caf%C3%A9&q=2&;bad"},
+		{"/search?", "/search", ""},
+		{"/search", "/search", ""},
+		{"/a?b?c", "/a", "b?c"},
+	}
+	for _, tt := range tests {
+		reader := bufio.NewReader(strings.NewReader("GET " + tt.target + " HTTP/1.1\r\nHost: x\r\n\r\n"))
+		req, err := parseRequest(nil, reader, requestLimits{})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.target, err)
+		}
+		if req.Path != tt.path || req.RawQuery != tt.rawQuery {
+			t.Errorf("%s: Path, RawQuery = %q, %q; want %q, %q", tt.target, req.Path, req.RawQuery, tt.path, tt.rawQuery)
+		}
+	}
+
+	// The parsed query is decoded, and a malformed pair doesn't spoil the rest.
+	req := newTestRequest("GET", "/search?q=a+b&x=%2F%20&%zz=1", nil, "")
+	if req.Query("q") != "a b" || req.Query("x") != "/ " {
+		t.Errorf(`Query("q"), Query("x") = %q, %q; want "a b", "/ "`, req.Query("q"), req.Query("x"))
+	}
+}
+
+func TestQueryValues(t *testing.T) {
+	req := newTestRequest("GET", "/items?id=3&sort=asc&id=1&id=2", nil, "")
+	if got := req.QueryValues("id"); !reflect.DeepEqual(got, []string{"3", "1", "2"}) {
+		t.Errorf(`QueryValues("id") = %q, want ["3" "1" "2"]`, got)
+	}
+	if got := req.QueryValues("sort"); !reflect.DeepEqual(got, []string{"asc"}) {
+		t.Errorf(`QueryValues("sort") = %q, want ["asc"]`, got)
+	}
+	if got := req.QueryValues("missing"); got == nil || len(got) != 0 {
+		t.Errorf(`QueryValues("missing") = %#v, want an empty slice`, got)
+	}
+}
+
+// brokenConn fails every write, as a connection to a client that went away.
+type brokenConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *brokenConn) Write(p []byte) (int, error) {
+	c.writes++
+	return 0, syscall.EPIPE
+}
+
+func TestWriteAfterConnectionFailed(t *testing.T) {
+	captureLog(t)
+	conn := &brokenConn{}
+	rw := newResponse(conn, bufio.NewWriter(conn))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rw.cancel = cancel
+
+	// More than fits in the buffer, so this write reaches the connection.
+	_, err := rw.Write(make([]byte, 2*bufferSize))
+	if !errors.Is(err, syscall.EPIPE) {
+		t.Fatalf("first write: err = %v, want EPIPE", err)
+	}
+	if ctx.Err() == nil {
+		t.Error("the request's context wasn't cancelled")
+	}
+	writes := conn.writes
+	for i := 0; i < 10; i++ {
+		if _, again := rw.Write(make([]byte, 2*bufferSize)); again != err {
+			t.Fatalf("write %d: err = %v, want the first error %v", i, again, err)
+		}
+		rw.Flush()
+	}
+	if conn.writes != writes {
+		t.Errorf("the connection was written to %d more times after it failed", conn.writes-writes)
+	}
+}
+
+func TestHandlerWritesAfterClientLeft(t *testing.T) {
+	captureLog(t)
+	s := NewServer("")
+	type result struct {
+		first, last error
+		cancelled   bool
+	}
+	results := make(chan result, 1)
+	s.Handle("GET", "/stream", func(w ResponseWriter, r *Request) {
+		var res result
+		chunk := make([]byte, 32<<10)
+		deadline := time.Now().Add(5 * time.Second)
+		for res.first == nil && time.Now().Before(deadline) {
+			_, res.first = w.Write(chunk)
+			w.Flush()
+		}
+		for i := 0; i < 100; i++ {
+			_, res.last = w.Write(chunk)
+		}
+		res.cancelled = r.Context().Err() != nil
+		results <- res
+	})
+	addr := startServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET /stream HTTP/1.1\r\nHost: x\r\n\r\n")
+	conn.Read(make([]byte, 1024))
+	conn.Close()
+
+	select {
+	case res := <-results:
+		if res.first == nil {
+			t.Fatal("writes kept succeeding after the client closed the connection")
+		}
+		if res.last != res.first || !res.cancelled {
+			t.Errorf("later writes: err = %v, context cancelled %v; want %v and cancelled", res.last, res.cancelled, res.first)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the handler hung writing to a closed connection")
+	}
+}
@@ -0,0 +1,160 @@
+// idempotency.go
+// This file implements idempotency keys. A client that retries a request
+// with the same Idempotency-Key header gets the original response back
+// instead of the handler running a second time, which makes retrying a POST
+// safe. A retry that arrives while the original is still being handled waits
+// for its response. A key reused for a different request is refused.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Store holds responses recorded by IdempotencyMiddleware. Implementations
+// decide how long entries live and must be safe for concurrent use.
+type Store interface {
+	Get(key string) (*StoredResponse, bool)
+	Set(key string, resp *StoredResponse)
+}
+
+// MemoryStore is an in-memory Store whose entries expire after a fixed TTL.
+type MemoryStore struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	lastSweep time.Time
+}
+
+type memoryEntry struct {
+	resp    *StoredResponse
+	expires time.Time
+}
+
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		ttl:       ttl,
+		entries:   make(map[string]memoryEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (ms *MemoryStore) Get(key string) (*StoredResponse, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry, ok := ms.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(ms.entries, key)
+		return nil, false
+	}
+	return entry.resp, true
+}
+
+func (ms *MemoryStore) Set(key string, resp *StoredResponse) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	// Expired entries that are never asked for again are swept now and then
+	// so the map doesn't grow without bound.
+	if now.Sub(ms.lastSweep) > time.Minute {
+		for k, entry := range ms.entries {
+			if now.After(entry.expires) {
+				delete(ms.entries, k)
+			}
+		}
+		ms.lastSweep = now
+	}
+	ms.entries[key] = memoryEntry{resp: resp, expires: now.Add(ms.ttl)}
+}
+
+// idempotentFlight is a request being handled under an idempotency key.
+type idempotentFlight struct {
+	flight
+	requestHash string
+}
+
+// requestHash fingerprints a request by its method, path, query and body,
+// which a retry under the same idempotency key has to repeat exactly.
+func requestHash(r *Request) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.Path + "?" + r.RawQuery + "\n"))
+	h.Write([]byte(r.Body()))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// IdempotencyMiddleware replays the stored response for requests whose
+// Idempotency-Key has been seen before. Requests without the header pass
+// straight through. 5xx responses aren't stored, so a request that failed on
+// the server side can be retried for real. A request whose key is still being
+// handled waits for that response and gets it too. The body is read into
+// memory to tell a retry from a different request reusing the key (another
+// method, path, query or body), which is answered with 422.
+func IdempotencyMiddleware(store Store) Middleware {
+	var mu sync.Mutex
+	flights := make(map[string]*idempotentFlight)
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			key := r.Headers["Idempotency-Key"]
+			if key == "" {
+				next(w, r)
+				return
+			}
+			hash := requestHash(r)
+
+			// The store is checked under mu as well, so a request can't slip
+			// in between the first one storing its response and leaving flights.
+			mu.Lock()
+			if f, ok := flights[key]; ok {
+				mu.Unlock()
+				if f.requestHash != hash {
+					httpError(w, r, 422)
+					return
+				}
+				<-f.done
+				if f.result.Status < 500 {
+					w.SetHeader("Idempotent-Replayed", "true")
+				}
+				f.result.writeTo(w)
+				return
+			}
+			if stored, ok := store.Get(key); ok {
+				mu.Unlock()
+				if stored.RequestHash != hash {
+					httpError(w, r, 422)
+					return
+				}
+				w.SetHeader("Idempotent-Replayed", "true")
+				stored.writeTo(w)
+				return
+			}
+			f := &idempotentFlight{flight: flight{done: make(chan struct{})}, requestHash: hash}
+			flights[key] = f
+			mu.Unlock()
+
+			rec := newResponseRecorder()
+			// Waiters are released even if the handler panics.
+			defer func() {
+				if f.result == nil {
+					f.result = &StoredResponse{Status: 500, Body: []byte("500 Internal Server Error")}
+				} else if f.result.Status < 500 {
+					f.result.RequestHash = hash
+					store.Set(key, f.result)
+				}
+				mu.Lock()
+				delete(flights, key)
+				mu.Unlock()
+				close(f.done)
+			}()
+			next(rec, r)
+			f.result = rec.result()
+			f.result.writeTo(w)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveRecorded runs h for r and returns the recorded response.
+func serveRecorded(h HandlerFunc, r *Request) *StoredResponse {
+	rec := newResponseRecorder()
+	h(rec, r)
+	return rec.result()
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	var runs atomic.Int32
+	h := IdempotencyMiddleware(NewMemoryStore(time.Minute))(func(w ResponseWriter, r *Request) {
+		w.WriteHeader(201)
+		fmt.Fprintf(w, "order %d", runs.Add(1))
+	})
+	post := func(key string) *StoredResponse {
+		return serveRecorded(h, newTestRequest("POST", "/orders", map[string]string{"Idempotency-Key": key}, ""))
+	}
+
+	first := post("a")
+	replay := post("a")
+	if string(first.Body) != "order 1" || first.Status != 201 {
+		t.Fatalf("first response = %d %q", first.Status, first.Body)
+	}
+	if string(replay.Body) != "order 1" || replay.Status != 201 || replay.Headers["Idempotent-Replayed"] != "true" {
+		t.Errorf("repeated key: response = %d %q %v, want the replayed first one", replay.Status, replay.Body, replay.Headers)
+	}
+	if other := post("b"); string(other.Body) != "order 2" || other.Headers["Idempotent-Replayed"] != "" {
+		t.Errorf("distinct key: response = %q %v, want a new order", other.Body, other.Headers)
+	}
+
+	// Without a key every request is processed.
+	serveRecorded(h, newTestRequest("POST", "/orders", nil, ""))
+	serveRecorded(h, newTestRequest("POST", "/orders", nil, ""))
+	if got := runs.Load(); got != 4 {
+		t.Errorf("handler ran %d times, want 4", got)
+	}
+}
+
+func TestIdempotencyMiddlewareConcurrentRetries(t *testing.T) {
+	var runs atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := IdempotencyMiddleware(NewMemoryStore(time.Minute))(func(w ResponseWriter, r *Request) {
+		if runs.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		w.Write([]byte("done"))
+	})
+	post := func() *StoredResponse {
+		return serveRecorded(h, newTestRequest("POST", "/orders", map[string]string{"Idempotency-Key": "k"}, ""))
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]*StoredResponse, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		responses[0] = post()
+	}()
+	<-started
+	// The retries arrive while the first request is still being handled.
+	for i := 1; i < len(responses); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = post()
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := runs.Load(); got != 1 {
+		t.Errorf("handler ran %d times, want 1", got)
+	}
+	for i, resp := range responses {
+		if string(resp.Body) != "done" {
+			t.Errorf("response %d = %q", i, resp.Body)
+		}
+	}
+}
+
+func TestIdempotencyMiddlewareServerErrorsNotStored(t *testing.T) {
+	var runs atomic.Int32
+	h := IdempotencyMiddleware(NewMemoryStore(time.Minute))(func(w ResponseWriter, r *Request) {
+		if runs.Add(1) == 1 {
+			httpError(w, r, 503)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	r := func() *Request {
+		return newTestRequest("POST", "/orders", map[string]string{"Idempotency-Key": "k"}, "")
+	}
+	if resp := serveRecorded(h, r()); resp.Status != 503 {
+		t.Fatalf("first status = %d", resp.Status)
+	}
+	if resp := serveRecorded(h, r()); resp.Status != 200 || runs.Load() != 2 {
+		t.Errorf("retry after a 503: status %d after %d runs, want a real second run", resp.Status, runs.Load())
+	}
+}
+
+func TestIdempotencyMiddlewareKeyReuse(t *testing.T) {
+	var runs atomic.Int32
+	h := IdempotencyMiddleware(NewMemoryStore(time.Minute))(func(w ResponseWriter, r *Request) {
+		runs.Add(1)
+		w.Write([]byte("charged " + r.Body()))
+	})
+	send := func(method, target, body string) *StoredResponse {
+		return serveRecorded(h, newTestRequest(method, target, map[string]string{"Idempotency-Key": "k"}, body))
+	}
+
+	if resp := send("POST", "/charges", "amount=10"); resp.Status != 200 || string(resp.Body) != "charged amount=10" {
+		t.Fatalf("first response = %d %q", resp.Status, resp.Body)
+	}
+	tests := []struct {
+		name, method, target, body string
+	}{
+		{"different body", "POST", "/charges", "amount=1000"},
+		{"different path", "POST", "/refunds", "amount=10"},
+		{"different query", "POST", "/charges?currency=eur", "amount=10"},
+		{"different method", "PUT", "/charges", "amount=10"},
+	}
+	for _, tt := range tests {
+		if resp := send(tt.method, tt.target, tt.body); resp.Status != 422 {
+			t.Errorf("%s: status = %d, want 422", tt.name, resp.Status)
+		}
+	}
+	if resp := send("POST", "/charges", "amount=10"); string(resp.Body) != "charged amount=10" || resp.Headers["Idempotent-Replayed"] != "true" {
+		t.Errorf("exact retry: response = %q %v, want the replayed first one", resp.Body, resp.Headers)
+	}
+	if got := runs.Load(); got != 1 {
+		t.Errorf("handler ran %d times, want 1", got)
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	ms := NewMemoryStore(20 * time.Millisecond)
+	ms.Set("k", &StoredResponse{Status: 200})
+	if _, ok := ms.Get("k"); !ok {
+		t.Fatal("fresh entry missing")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := ms.Get("k"); ok {
+		t.Error("entry still there after its TTL")
+	}
+}
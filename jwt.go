@@ -0,0 +1,122 @@
+// jwt.go
+// This file contains JSON Web Token authentication. The middleware reads a
+// bearer token, verifies its signature (HS256 or RS256) and expiry, and
+// makes the claims available to handlers with r.Get("claims").
+
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// JWT is a decoded token. KeyFuncs can use the header (e.g. "kid") to pick
+// the verification key.
+type JWT struct {
+	Header map[string]any
+	Claims map[string]any
+}
+
+// KeyFunc returns the key that verifies a token: a []byte secret for HS256,
+// or an *rsa.PublicKey for RS256.
+type KeyFunc func(token *JWT) (key any, err error)
+
+var errTokenExpired = errors.New("token expired")
+
+// JWTAuthMiddleware rejects requests without a valid bearer token with 401.
+// On success the token's claims are stored on the request under "claims".
+func JWTAuthMiddleware(keyFunc KeyFunc) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			raw, ok := r.BearerToken()
+			if !ok {
+				w.SetHeader("WWW-Authenticate", "Bearer")
+				httpError(w, r, 401)
+				return
+			}
+			token, err := parseJWT(raw, keyFunc, time.Now())
+			if err != nil {
+				log.Printf("Rejected token: %v", err)
+				w.SetHeader("WWW-Authenticate", `Bearer error="invalid_token"`)
+				httpError(w, r, 401)
+				return
+			}
+			r.Set("claims", token.Claims)
+			next(w, r)
+		}
+	}
+}
+
+// parseJWT decodes a compact-serialized token, verifies its signature with
+// the key from keyFunc, and checks "exp" and "nbf" against now.
+func parseJWT(raw string, keyFunc KeyFunc, now time.Time) (*JWT, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	token := &JWT{}
+	if err := decodeJWTPart(parts[0], &token.Header); err != nil {
+		return nil, fmt.Errorf("header: %v", err)
+	}
+	if err := decodeJWTPart(parts[1], &token.Claims); err != nil {
+		return nil, fmt.Errorf("claims: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %v", err)
+	}
+
+	key, err := keyFunc(token)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch alg, _ := token.Header["alg"].(string); alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("HS256 needs a []byte key, got %T", key)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, fmt.Errorf("invalid signature")
+		}
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("RS256 needs an *rsa.PublicKey, got %T", key)
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, fmt.Errorf("invalid signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported alg %q", alg)
+	}
+
+	if exp, ok := token.Claims["exp"].(float64); ok && !now.Before(time.Unix(int64(exp), 0)) {
+		return nil, errTokenExpired
+	}
+	if nbf, ok := token.Claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+	return token, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
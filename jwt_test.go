@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// signJWT builds a compact token signed with key: a []byte secret for HS256
+// or an *rsa.PrivateKey for RS256.
+func signJWT(t *testing.T, alg string, key any, claims map[string]any) string {
+	t.Helper()
+	part := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := part(map[string]any{"alg": alg, "typ": "JWT"}) + "." + part(claims)
+	var sig []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuthMiddleware(t *testing.T) {
+	secret := []byte("s3cret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFunc := func(token *JWT) (any, error) {
+		if token.Header["alg"] == "RS256" {
+			return &rsaKey.PublicKey, nil
+		}
+		return secret, nil
+	}
+	future := float64(time.Now().Add(time.Hour).Unix())
+	past := float64(time.Now().Add(-time.Hour).Unix())
+
+	tests := []struct {
+		name   string
+		token  string // Empty means no Authorization header.
+		status int
+	}{
+		{"HS256 valid", signJWT(t, "HS256", secret, map[string]any{"sub": "ali", "exp": future}), 200},
+		{"RS256 valid", signJWT(t, "RS256", rsaKey, map[string]any{"sub": "ali", "exp": future}), 200},
+		{"HS256 expired", signJWT(t, "HS256", secret, map[string]any{"sub": "ali", "exp": past}), 401},
+		{"RS256 expired", signJWT(t, "RS256", rsaKey, map[string]any{"sub": "ali", "exp": past}), 401},
+		{"HS256 bad signature", signJWT(t, "HS256", []byte("wrong"), map[string]any{"sub": "ali", "exp": future}), 401},
+		{"RS256 bad signature", signJWT(t, "RS256", otherKey, map[string]any{"sub": "ali", "exp": future}), 401},
+		{"not yet valid", signJWT(t, "HS256", secret, map[string]any{"sub": "ali", "nbf": future}), 401},
+		{"unsupported alg", signJWT(t, "none", nil, map[string]any{"sub": "ali"}), 401},
+		{"malformed", "abc.def", 401},
+		{"missing", "", 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims any
+			h := JWTAuthMiddleware(keyFunc)(func(w ResponseWriter, r *Request) {
+				claims = r.Get("claims")
+				w.WriteHeader(200)
+			})
+			headers := map[string]string{}
+			if tt.token != "" {
+				headers["Authorization"] = "Bearer " + tt.token
+			}
+			res := serveRecorded(h, newTestRequest("GET", "/", headers, ""))
+			if res.Status != tt.status {
+				t.Fatalf("status = %d, want %d", res.Status, tt.status)
+			}
+			if tt.status == 401 {
+				if res.Headers["WWW-Authenticate"] == "" {
+					t.Error("401 without a WWW-Authenticate header")
+				}
+				return
+			}
+			if c, ok := claims.(map[string]any); !ok || c["sub"] != "ali" {
+				t.Errorf(`r.Get("claims") = %v, want sub "ali"`, claims)
+			}
+		})
+	}
+}
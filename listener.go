@@ -0,0 +1,227 @@
+// listener.go
+// This file contains the accept loop and the bookkeeping behind graceful
+// shutdown. Every listener being served is tracked together with its
+// connections, so one listener can be shut down and drained while the
+// others keep serving.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trackedListener is a listener being served and the connections it accepted.
+type trackedListener struct {
+	net.Listener
+	stopping atomic.Bool
+	stopOnce sync.Once
+	wg       sync.WaitGroup // Counts open connections.
+
+	mu    sync.Mutex
+	conns map[net.Conn]*connInfo
+}
+
+// connInfo is what the registry knows about a connection.
+type connInfo struct {
+	state    ConnState
+	accepted time.Time
+}
+
+// Serve accepts connections on l until it is shut down, either on its own
+// with ShutdownListener or together with the whole server. It then waits
+// for l's open connections to finish and returns nil. Serve can run for
+// several listeners at the same time.
+func (s *Server) Serve(l net.Listener) error {
+	tl := &trackedListener{Listener: l, conns: make(map[net.Conn]*connInfo)}
+	s.mu.Lock()
+	if s.inShutdown.Load() {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listeners[l] = tl
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if tl.stopping.Load() {
+				tl.wg.Wait()
+				return nil
+			}
+			tl.stop()
+			tl.wg.Wait()
+			return err
+		}
+
+		tl.wg.Add(1)
+		s.setState(tl, conn, StateNew)
+		go s.handleConnection(conn, tl)
+	}
+}
+
+// ShutdownListener stops accepting connections on l, which must be served
+// by Serve, and waits until the connections it accepted have finished their
+// current request. Idle connections are closed right away. Other listeners
+// are not affected.
+func (s *Server) ShutdownListener(l net.Listener) error {
+	s.mu.Lock()
+	tl, ok := s.listeners[l]
+	s.mu.Unlock()
+	if !ok {
+		return errors.New("listener is not being served")
+	}
+	tl.stop()
+	tl.wg.Wait()
+	return nil
+}
+
+// Stop shuts the server down gracefully, just like SIGINT does: no new
+// connections are accepted, and ListenAndServe and Serve return nil once the
+// open connections have finished their current request. It doesn't wait for
+// that itself. From then on SIGINT and SIGTERM are no longer caught.
+// Calling it again, or after a signal, does nothing.
+func (s *Server) Stop() {
+	s.shutdown()
+}
+
+// shutdown stops every listener. Each Serve call returns once its own
+// connections have drained.
+func (s *Server) shutdown() {
+	s.mu.Lock()
+	s.inShutdown.Store(true)
+	listeners := make([]*trackedListener, 0, len(s.listeners))
+	for _, tl := range s.listeners {
+		listeners = append(listeners, tl)
+	}
+	s.mu.Unlock()
+	s.shutdownOnce.Do(func() { close(s.shuttingDown) })
+
+	for _, tl := range listeners {
+		tl.stop()
+	}
+}
+
+// stop closes the listener and wakes connections that are waiting for a
+// request, so they close instead of waiting out their read deadline.
+// Connections in the middle of a request finish it first.
+func (tl *trackedListener) stop() {
+	tl.stopOnce.Do(func() {
+		tl.stopping.Store(true)
+		tl.Listener.Close()
+
+		tl.mu.Lock()
+		defer tl.mu.Unlock()
+		for conn, info := range tl.conns {
+			if info.state == StateNew || info.state == StateIdle {
+				conn.SetReadDeadline(time.Now())
+			}
+		}
+	})
+}
+
+// setState records a connection's new state and reports it to the ConnState hook.
+func (s *Server) setState(tl *trackedListener, conn net.Conn, state ConnState) {
+	tl.mu.Lock()
+	switch {
+	case state == StateClosed:
+		delete(tl.conns, conn)
+	case tl.conns[conn] == nil:
+		tl.conns[conn] = &connInfo{state: state, accepted: time.Now()}
+	default:
+		tl.conns[conn].state = state
+	}
+	tl.mu.Unlock()
+
+	if s.connState != nil {
+		s.connState(conn, state)
+	}
+}
+
+// acquireConnSlot takes one of the MaxConns connection slots, waiting up to
+// ConnWaitTimeout for one to free up. It reports whether it got one.
+// Connections waiting at the same time get slots in the order they came.
+func (s *Server) acquireConnSlot() bool {
+	if s.MaxConns <= 0 {
+		return true
+	}
+	s.slotsOnce.Do(func() {
+		s.connSlots = make(chan struct{}, s.MaxConns)
+	})
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	default:
+	}
+	if s.ConnWaitTimeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(s.ConnWaitTimeout)
+	defer timer.Stop()
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (s *Server) releaseConnSlot() {
+	if s.MaxConns > 0 {
+		<-s.connSlots
+	}
+}
+
+// connectionInfo is one entry of the ConnectionsHandler listing.
+type connectionInfo struct {
+	Listener   string  `json:"listener"`
+	RemoteAddr string  `json:"remote_addr"`
+	State      string  `json:"state"`
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+// ConnectionsHandler lists the open connections of every listener as JSON,
+// with their remote address, state and age, oldest first. It exposes
+// client addresses, so nothing registers it by default; mount it yourself,
+// behind IPAllowlistMiddleware or similar, where you need it.
+func (s *Server) ConnectionsHandler() HandlerFunc {
+	return func(w ResponseWriter, r *Request) {
+		now := time.Now()
+		conns := []connectionInfo{}
+		s.mu.Lock()
+		for _, tl := range s.listeners {
+			tl.mu.Lock()
+			for conn, info := range tl.conns {
+				conns = append(conns, connectionInfo{
+					Listener:   tl.Addr().String(),
+					RemoteAddr: conn.RemoteAddr().String(),
+					State:      info.state.String(),
+					AgeSeconds: now.Sub(info.accepted).Seconds(),
+				})
+			}
+			tl.mu.Unlock()
+		}
+		s.mu.Unlock()
+		sort.Slice(conns, func(i, j int) bool { return conns[i].AgeSeconds > conns[j].AgeSeconds })
+
+		body, err := json.Marshal(conns)
+		if err != nil {
+			httpError(w, r, 500)
+			return
+		}
+		w.SetHeader("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
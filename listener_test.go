@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownListener(t *testing.T) {
+	s := NewServer("")
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("ok"))
+	})
+	s.Handle("GET", "/slow", func(w ResponseWriter, r *Request) {
+		close(entered)
+		<-release
+		w.Write([]byte("slow"))
+	})
+
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDone := make(chan error, 1)
+	go func() { publicDone <- s.Serve(public) }()
+	adminAddr := startServer(t, s)
+	publicAddr := public.Addr().String()
+
+	// Once a request has been answered, Serve is tracking the listener.
+	idle, err := net.Dial("tcp", publicAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(idle, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	idleReader := bufio.NewReader(idle)
+	readResponse(t, idleReader)
+
+	busy, err := net.Dial("tcp", publicAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	busy.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(busy, "GET /slow HTTP/1.1\r\nHost: x\r\n\r\n")
+	<-entered
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- s.ShutdownListener(public) }()
+
+	// The idle connection is closed right away.
+	if _, err := idleReader.ReadByte(); err != io.EOF {
+		t.Errorf("idle connection: read err = %v, want EOF", err)
+	}
+	// No new connections are accepted.
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", publicAddr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("public listener still accepts connections")
+		}
+	}
+	// The other listener keeps serving.
+	resp := rawRequest(t, adminAddr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if !strings.HasSuffix(resp, "ok") {
+		t.Errorf("admin listener: response = %q, want ok", resp)
+	}
+
+	// The request in progress finishes before the shutdown completes.
+	select {
+	case err := <-shutdownDone:
+		t.Fatalf("ShutdownListener returned %v before the request finished", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if res, body := readResponse(t, bufio.NewReader(busy)); res.StatusCode != 200 || body != "slow" {
+		t.Errorf("in-flight request: response = %d %q, want 200 slow", res.StatusCode, body)
+	}
+	for name, done := range map[string]chan error{"ShutdownListener": shutdownDone, "Serve": publicDone} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("%s = %v, want nil", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s didn't return", name)
+		}
+	}
+
+	if err := s.ShutdownListener(public); err == nil {
+		t.Error("ShutdownListener on a listener no longer served: want an error")
+	}
+}
+
+func TestConnWaitTimeout(t *testing.T) {
+	captureLog(t)
+	s := NewServer("")
+	s.MaxConns = 1
+	s.ConnWaitTimeout = 200 * time.Millisecond
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("ok"))
+	})
+	addr := startServer(t, s)
+
+	// holdSlot opens a kept-alive connection, which keeps its slot while idle.
+	holdSlot := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+		readResponse(t, bufio.NewReader(conn))
+		return conn
+	}
+
+	t.Run("slot frees up", func(t *testing.T) {
+		holder := holdSlot()
+		done := make(chan string, 1)
+		go func() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				done <- err.Error()
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+			data, _ := io.ReadAll(conn)
+			done <- string(data)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		holder.Close()
+		if resp := <-done; !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+			t.Errorf("waiting connection: response = %q, want 200", resp)
+		}
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		holder := holdSlot()
+		defer holder.Close()
+		start := time.Now()
+		resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		if !strings.HasPrefix(resp, "HTTP/1.1 503 ") {
+			t.Errorf("response = %q, want 503", resp)
+		}
+		if elapsed := time.Since(start); elapsed < s.ConnWaitTimeout {
+			t.Errorf("rejected after %v, before ConnWaitTimeout", elapsed)
+		}
+	})
+}
+
+func TestConnectionsHandler(t *testing.T) {
+	s := NewServer("")
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("ok"))
+	})
+	s.Handle("GET", "/debug/connections", s.ConnectionsHandler())
+	addr := startServer(t, s)
+
+	// Two clients keep their connections open after a request.
+	idle := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+		readResponse(t, bufio.NewReader(conn))
+		idle[conn.LocalAddr().String()] = true
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	resp := rawRequest(t, addr, "GET /debug/connections HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	res, body := readResponse(t, bufio.NewReader(strings.NewReader(resp)))
+	if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var conns []connectionInfo
+	if err := json.Unmarshal([]byte(body), &conns); err != nil {
+		t.Fatalf("body %q: %v", body, err)
+	}
+	if len(conns) != 3 {
+		t.Fatalf("listed %d connections, want 3: %s", len(conns), body)
+	}
+	for i, c := range conns {
+		if c.Listener != addr {
+			t.Errorf("connection %s: listener = %q, want %q", c.RemoteAddr, c.Listener, addr)
+		}
+		if idle[c.RemoteAddr] != (c.State == "idle") {
+			t.Errorf("connection %s: state = %q", c.RemoteAddr, c.State)
+		}
+		if i > 0 && c.AgeSeconds > conns[i-1].AgeSeconds {
+			t.Errorf("connections not listed oldest first: %s", body)
+		}
+	}
+	// The listing's own connection is the newest, and busy.
+	if last := conns[2]; last.State != "active" || idle[last.RemoteAddr] {
+		t.Errorf("last connection = %+v, want the active one making the request", last)
+	}
+}
@@ -0,0 +1,82 @@
+// maintenance.go
+// This file contains maintenance mode. While it is on, every request is
+// answered with 503 and a Retry-After, optionally with a branded HTML page,
+// and it can be switched on and off while the server runs.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Maintenance is a maintenance mode switch. Register its Middleware, then
+// Enable and Disable it as needed.
+type Maintenance struct {
+	// RetryAfter is sent to tell clients when to come back. Zero leaves
+	// the header out.
+	RetryAfter time.Duration
+
+	// PageFile is an HTML file served as the body of the 503. It is read
+	// when maintenance mode is enabled and kept in memory. Empty means the
+	// plain default error response.
+	PageFile string
+
+	enabled atomic.Bool
+	mu      sync.Mutex
+	page    []byte
+}
+
+// Enable turns maintenance mode on, reading PageFile afresh so changes to
+// it show. If the file can't be read, the default 503 is used instead.
+func (m *Maintenance) Enable() {
+	var page []byte
+	if m.PageFile != "" {
+		var err error
+		if page, err = os.ReadFile(m.PageFile); err != nil {
+			log.Printf("Error reading maintenance page: %v", err)
+		}
+	}
+	m.mu.Lock()
+	m.page = page
+	m.mu.Unlock()
+	m.enabled.Store(true)
+}
+
+// Disable turns maintenance mode off.
+func (m *Maintenance) Disable() {
+	m.enabled.Store(false)
+}
+
+// Enabled reports whether maintenance mode is on.
+func (m *Maintenance) Enabled() bool {
+	return m.enabled.Load()
+}
+
+// Middleware answers every request with 503 while maintenance mode is on.
+func (m *Maintenance) Middleware(next HandlerFunc) HandlerFunc {
+	return func(w ResponseWriter, r *Request) {
+		if !m.enabled.Load() {
+			next(w, r)
+			return
+		}
+		if m.RetryAfter > 0 {
+			w.SetHeader("Retry-After", fmt.Sprint(int(math.Ceil(m.RetryAfter.Seconds()))))
+		}
+		m.mu.Lock()
+		page := m.page
+		m.mu.Unlock()
+		if page == nil {
+			httpError(w, r, 503)
+			return
+		}
+		w.SetHeader("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(503)
+		w.Write(page)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenancePage(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"maintenance.html": "<h1>Back soon</h1>"})
+	page := filepath.Join(dir, "maintenance.html")
+	m := &Maintenance{RetryAfter: 90 * time.Second, PageFile: page}
+	h := m.Middleware(func(w ResponseWriter, r *Request) {
+		w.Write([]byte("ok"))
+	})
+	get := func() *StoredResponse {
+		return serveRecorded(h, newTestRequest("GET", "/", nil, ""))
+	}
+
+	if got := get(); got.Status != 200 || string(got.Body) != "ok" {
+		t.Errorf("before Enable: response = %d %q, want the handler's", got.Status, got.Body)
+	}
+
+	m.Enable()
+	got := get()
+	if got.Status != 503 || string(got.Body) != "<h1>Back soon</h1>" {
+		t.Errorf("enabled: response = %d %q, want 503 with the page", got.Status, got.Body)
+	}
+	if got.Headers["Content-Type"] != "text/html; charset=utf-8" || got.Headers["Retry-After"] != "90" {
+		t.Errorf("enabled: headers = %v, want HTML and Retry-After: 90", got.Headers)
+	}
+
+	// The page is read by Enable, not on every request.
+	if err := os.WriteFile(page, []byte("<h1>Changed</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(); string(got.Body) != "<h1>Back soon</h1>" {
+		t.Errorf("after editing the file: body = %q, want the cached page", got.Body)
+	}
+	m.Enable()
+	if got := get(); string(got.Body) != "<h1>Changed</h1>" {
+		t.Errorf("after enabling again: body = %q, want the new page", got.Body)
+	}
+
+	m.Disable()
+	if got := get(); got.Status != 200 {
+		t.Errorf("after Disable: status = %d, want 200", got.Status)
+	}
+
+	captureLog(t)
+	m.PageFile = filepath.Join(dir, "missing.html")
+	m.Enable()
+	if got := get(); got.Status != 503 || !strings.Contains(string(got.Body), "Service Unavailable") {
+		t.Errorf("missing page: response = %d %q, want the default 503", got.Status, got.Body)
+	}
+}
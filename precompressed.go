@@ -0,0 +1,95 @@
+// precompressed.go
+// This file lets the file server send precompressed copies of static files.
+// A file like "app.js" may have "app.js.br" and "app.js.gz" next to it, made
+// at build time; the client gets whichever of them it prefers according to
+// its Accept-Encoding, or the plain file if it takes neither, unless it
+// refuses that as well and gets 406.
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// precompressedEncodings maps content codings to the suffix of their files,
+// best compression first, so it wins when the client likes both equally.
+var precompressedEncodings = []struct {
+	coding string
+	suffix string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// precompressedVariant picks the precompressed copy of filePath to send for
+// r, or none (an empty variantPath) if the client prefers the plain file.
+// variants reports whether there are any copies, in which case the response
+// depends on Accept-Encoding; ok reports whether the client accepts what was
+// picked, which it doesn't if it refuses identity and every copy.
+func precompressedVariant(r *Request, filePath string) (variantPath, coding string, variants, ok bool) {
+	acceptEncoding := r.Headers["Accept-Encoding"]
+	// The plain file is the identity coding. A copy wins a tie with it, and
+	// between copies the first listed wins.
+	best := encodingQuality(acceptEncoding, "identity")
+	for _, enc := range precompressedEncodings {
+		info, err := os.Stat(filePath + enc.suffix)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		variants = true
+		if q := encodingQuality(acceptEncoding, enc.coding); q > 0 && (q > best || q == best && variantPath == "") {
+			best, variantPath, coding = q, filePath+enc.suffix, enc.coding
+		}
+	}
+	return variantPath, coding, variants, best > 0
+}
+
+// encodingQuality returns the quality value (0 to 1) an Accept-Encoding
+// header gives coding, taking a "*" entry for codings it doesn't name. Zero
+// means the coding isn't acceptable. identity is acceptable unless refused
+// by name or by "*;q=0", though if not named it ranks below every coding
+// that is.
+func encodingQuality(acceptEncoding, coding string) float64 {
+	wildcard := -1.0
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(entry, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q, ok := qualityParam(params)
+		if !ok {
+			continue
+		}
+		switch name {
+		case coding:
+			return q
+		case "*":
+			wildcard = q
+		}
+	}
+	if wildcard >= 0 {
+		return wildcard
+	}
+	if coding == "identity" {
+		// Below any q value a client can send, which has three decimals at most.
+		return 0.0001
+	}
+	return 0
+}
+
+// qualityParam returns the q parameter among the parameters of an
+// Accept-Encoding entry, 1 if there is none. ok is false if it is malformed.
+func qualityParam(params string) (q float64, ok bool) {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || !(q >= 0 && q <= 1) {
+			return 0, false
+		}
+		return q, true
+	}
+	return 1, true
+}
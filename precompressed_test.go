@@ -0,0 +1,74 @@
+package main
+
+import (
+	"mime"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrecompressedVariants(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app.js":       "plain",
+		"app.js.br":    "brotli",
+		"app.js.gz":    "gzip",
+		"style.css":    "plain css",
+		"style.css.gz": "gzip css",
+		"logo.svg":     "plain svg",
+	})
+	h := MultiFileServer(dir)
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		body           string
+		coding         string // Expected Content-Encoding.
+		vary           bool
+	}{
+		{"prefers br", "/app.js", "gzip;q=0.5, br", "brotli", "br", true},
+		{"prefers gzip", "/app.js", "gzip, br;q=0.2", "gzip", "gzip", true},
+		{"equal: best compression", "/app.js", "gzip, br", "brotli", "br", true},
+		{"wildcard", "/app.js", "*", "brotli", "br", true},
+		{"refuses br", "/app.js", "*, br;q=0", "gzip", "gzip", true},
+		{"neither", "/app.js", "identity", "plain", "", true},
+		{"prefers identity", "/app.js", "br;q=0.5, gzip;q=0.5, identity", "plain", "", true},
+		{"q after other params", "/app.js", "br;level=11;q=0.1, gzip; Q=0.5", "gzip", "gzip", true},
+		{"malformed q skipped", "/app.js", "br;q=high, gzip", "gzip", "gzip", true},
+		{"only copies allowed", "/app.js", "*;q=0, gzip", "gzip", "gzip", true},
+		{"no header", "/app.js", "", "plain", "", true},
+		{"only gzip exists", "/style.css", "br, gzip;q=0.8", "gzip css", "gzip", true},
+		{"no variants", "/logo.svg", "br, gzip", "plain svg", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.acceptEncoding != "" {
+				headers["Accept-Encoding"] = tt.acceptEncoding
+			}
+			res := serveRecorded(h, newTestRequest("GET", tt.path, headers, ""))
+			if string(res.Body) != tt.body || res.Headers["Content-Encoding"] != tt.coding {
+				t.Errorf("response = %q with Content-Encoding %q, want %q with %q", res.Body, res.Headers["Content-Encoding"], tt.body, tt.coding)
+			}
+			if got := res.Headers["Vary"] == "Accept-Encoding"; got != tt.vary {
+				t.Errorf("Vary = %q", res.Headers["Vary"])
+			}
+			// The type is the original file's, not that of the compressed copy.
+			if want := mime.TypeByExtension(filepath.Ext(tt.path)); res.Headers["Content-Type"] != want {
+				t.Errorf("Content-Type = %q, want %q", res.Headers["Content-Type"], want)
+			}
+		})
+	}
+
+	// With identity refused and no acceptable copy there is nothing to send.
+	for _, tt := range []struct{ path, acceptEncoding string }{
+		{"/app.js", "identity;q=0"},
+		{"/app.js", "*;q=0"},
+		{"/logo.svg", "gzip, identity;q=0"},
+	} {
+		res := serveRecorded(h, newTestRequest("GET", tt.path, map[string]string{"Accept-Encoding": tt.acceptEncoding}, ""))
+		if res.Status != 406 {
+			t.Errorf("%s with %q: status %d, want 406", tt.path, tt.acceptEncoding, res.Status)
+		}
+	}
+}
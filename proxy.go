@@ -0,0 +1,163 @@
+// proxy.go
+// This file contains a reverse proxy handler, which passes requests on to an
+// upstream server and sends its response back to the client. Hop-by-hop
+// headers stay on their own hop, the client's address is added to
+// X-Forwarded-For, and TRACE and OPTIONS honour Max-Forwards.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// hopHeaders only apply to a single connection and are never forwarded.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate",
+	"Proxy-Authorization", "TE", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// proxyTransport doesn't use an environment proxy and leaves Accept-Encoding
+// and compressed bodies alone, so they pass through as the client and the
+// upstream sent them.
+var proxyTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DisableCompression = true
+	return t
+}()
+
+// ReverseProxy returns a handler that forwards requests to target, with the
+// request path appended to target's path. The upstream call ends with the
+// request's context, so it is given up when the client's deadline passes
+// (504) or the client goes away; an upstream that can't be reached gives 502.
+//
+// A TRACE or OPTIONS request with "Max-Forwards: 0" is answered by the proxy
+// itself; with a higher value it is forwarded with the value decremented.
+//
+// An upstream header sent several times is joined with commas, except
+// Set-Cookie, whose values are passed on one by one (see AddHeader).
+func ReverseProxy(target *url.URL) HandlerFunc {
+	return func(w ResponseWriter, r *Request) {
+		maxForwards, limited := 0, false
+		if r.Method == "TRACE" || r.Method == "OPTIONS" {
+			maxForwards, limited = r.MaxForwards()
+		}
+		if limited && maxForwards == 0 {
+			answerLastHop(w, r)
+			return
+		}
+
+		u := *target
+		u.Path = strings.TrimSuffix(target.Path, "/") + r.Path
+		u.RawPath = ""
+		if target.RawQuery == "" || r.RawQuery == "" {
+			u.RawQuery = target.RawQuery + r.RawQuery
+		} else {
+			u.RawQuery = target.RawQuery + "&" + r.RawQuery
+		}
+		var body io.Reader
+		if r.body != nil || r.bodyCached {
+			body = r.BodyReader()
+		}
+		out, err := http.NewRequestWithContext(r.Context(), r.Method, u.String(), body)
+		if err != nil {
+			log.Printf("Error building proxy request: %v", err)
+			httpError(w, r, 502)
+			return
+		}
+		out.ContentLength = -1
+		if body == nil {
+			out.ContentLength = 0
+		} else if n, err := strconv.ParseInt(r.Headers["Content-Length"], 10, 64); err == nil {
+			out.ContentLength = n
+		}
+		for name, value := range r.Headers {
+			if name != "Host" && name != "Content-Length" {
+				out.Header.Set(name, value)
+			}
+		}
+		removeHopHeaders(out.Header)
+		if limited {
+			out.Header.Set("Max-Forwards", strconv.Itoa(maxForwards-1))
+		}
+		if addr := r.peerAddr(); addr.IsValid() {
+			if prior := r.Headers["X-Forwarded-For"]; prior != "" {
+				out.Header.Set("X-Forwarded-For", prior+", "+addr.String())
+			} else {
+				out.Header.Set("X-Forwarded-For", addr.String())
+			}
+		}
+		out.Header.Set("X-Forwarded-Host", r.Host())
+
+		resp, err := proxyTransport.RoundTrip(out)
+		if err != nil {
+			log.Printf("Error proxying %s %s: %v", r.Method, u.Redacted(), err)
+			if errors.Is(err, context.DeadlineExceeded) {
+				httpError(w, r, 504)
+			} else {
+				httpError(w, r, 502)
+			}
+			return
+		}
+		defer resp.Body.Close()
+
+		removeHopHeaders(resp.Header)
+		for name, values := range resp.Header {
+			switch name {
+			case "Set-Cookie":
+				for _, value := range values {
+					w.AddHeader(name, value)
+				}
+			case "Content-Length":
+				w.SetHeader(name, values[0])
+			default:
+				w.SetHeader(name, strings.Join(values, ", "))
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			log.Printf("Error copying proxied response: %v", err)
+		}
+	}
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including those
+// named in its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, token := range strings.Split(h.Get("Connection"), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			h.Del(token)
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// answerLastHop answers a TRACE or OPTIONS request that may not be forwarded
+// any further. TRACE echoes the request as received, leaving out the
+// credentials; OPTIONS gets an empty 204.
+func answerLastHop(w ResponseWriter, r *Request) {
+	if r.Method == "OPTIONS" {
+		NoContent(w)
+		return
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s %s\r\n", r.Method, r.Path, r.Version)
+	for name, value := range r.Headers {
+		if name != "Authorization" && name != "Cookie" && name != "Proxy-Authorization" {
+			fmt.Fprintf(&sb, "%s: %s\r\n", name, value)
+		}
+	}
+	sb.WriteString("\r\n")
+	w.SetHeader("Content-Type", "message/http")
+	w.Write([]byte(sb.String()))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// startProxy serves a ReverseProxy to upstream for GET, HEAD, TRACE and
+// OPTIONS requests to /echo and returns its address.
+func startProxy(t *testing.T, upstream string) string {
+	t.Helper()
+	target, err := url.Parse(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("")
+	proxy := ReverseProxy(target)
+	for _, method := range []string{"GET", "HEAD", "TRACE", "OPTIONS"} {
+		s.Handle(method, "/echo", proxy)
+	}
+	return startServer(t, s)
+}
+
+func TestReverseProxyMaxForwards(t *testing.T) {
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.Header().Set("X-Upstream", "yes")
+		w.Write([]byte("from upstream"))
+	}))
+	defer upstream.Close()
+	addr := startProxy(t, upstream.URL)
+
+	send := func(method, maxForwards string) (*http.Response, string) {
+		raw := method + " /echo HTTP/1.1\r\nHost: x\r\nAuthorization: secret\r\nConnection: close\r\n"
+		if maxForwards != "" {
+			raw += "Max-Forwards: " + maxForwards + "\r\n"
+		}
+		resp := rawRequest(t, addr, raw+"\r\n")
+		return readResponse(t, bufio.NewReader(strings.NewReader(resp)))
+	}
+	forwarded := func() http.Header {
+		select {
+		case h := <-received:
+			return h
+		default:
+			return nil
+		}
+	}
+
+	for _, method := range []string{"TRACE", "OPTIONS"} {
+		t.Run(method+" decremented", func(t *testing.T) {
+			res, body := send(method, "3")
+			if res.StatusCode != 200 || body != "from upstream" {
+				t.Fatalf("response = %d %q, want the upstream's", res.StatusCode, body)
+			}
+			if got := forwarded().Get("Max-Forwards"); got != "2" {
+				t.Errorf("upstream got Max-Forwards %q, want 2", got)
+			}
+		})
+	}
+
+	t.Run("TRACE at zero", func(t *testing.T) {
+		res, body := send("TRACE", "0")
+		if h := forwarded(); h != nil {
+			t.Fatal("request was forwarded")
+		}
+		if res.StatusCode != 200 || res.Header.Get("Content-Type") != "message/http" {
+			t.Errorf("response = %d %q, want the request echoed as message/http", res.StatusCode, res.Header.Get("Content-Type"))
+		}
+		if !strings.HasPrefix(body, "TRACE /echo HTTP/1.1\r\n") || !strings.Contains(body, "Max-Forwards: 0\r\n") {
+			t.Errorf("echo = %q, want the request as received", body)
+		}
+		if strings.Contains(body, "secret") {
+			t.Errorf("echo = %q, want credentials left out", body)
+		}
+	})
+
+	t.Run("OPTIONS at zero", func(t *testing.T) {
+		res, _ := send("OPTIONS", "0")
+		if h := forwarded(); h != nil {
+			t.Fatal("request was forwarded")
+		}
+		if res.StatusCode != 204 {
+			t.Errorf("status = %d, want 204 from the proxy", res.StatusCode)
+		}
+	})
+
+	t.Run("other methods", func(t *testing.T) {
+		// Max-Forwards only applies to TRACE and OPTIONS.
+		if res, _ := send("GET", "0"); res.StatusCode != 200 {
+			t.Errorf("status = %d, want 200", res.StatusCode)
+		}
+		if got := forwarded().Get("Max-Forwards"); got != "0" {
+			t.Errorf("upstream got Max-Forwards %q, want it untouched", got)
+		}
+	})
+
+	t.Run("no limit", func(t *testing.T) {
+		send("TRACE", "")
+		if h := forwarded(); h == nil || h.Get("Max-Forwards") != "" {
+			t.Errorf("upstream got %v, want the request without Max-Forwards", h)
+		}
+	})
+}
+
+func TestReverseProxyHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Add("Vary", "Accept")
+		w.Header().Add("Vary", "Cookie")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	addr := startProxy(t, upstream.URL)
+
+	resp := rawRequest(t, addr, "GET /echo HTTP/1.1\r\nHost: public.example\r\nX-Forwarded-For: 203.0.113.9\r\nProxy-Authorization: secret\r\nConnection: close, X-Private\r\nX-Private: 1\r\nX-Kept: 1\r\n\r\n")
+	res, _ := readResponse(t, bufio.NewReader(strings.NewReader(resp)))
+	h := <-received
+	if got := h.Get("X-Forwarded-For"); got != "203.0.113.9, 127.0.0.1" {
+		t.Errorf("X-Forwarded-For = %q", got)
+	}
+	if got := h.Get("X-Forwarded-Host"); got != "public.example" {
+		t.Errorf("X-Forwarded-Host = %q", got)
+	}
+	for _, name := range []string{"Proxy-Authorization", "X-Private"} {
+		if h.Get(name) != "" {
+			t.Errorf("hop-by-hop header %s was forwarded", name)
+		}
+	}
+	if h.Get("X-Kept") != "1" {
+		t.Error("end-to-end header X-Kept was dropped")
+	}
+	if res.Header.Get("X-Hop") != "" {
+		t.Error("upstream's hop-by-hop header X-Hop was passed back")
+	}
+	if got := res.Header.Get("Vary"); got != "Accept, Cookie" {
+		t.Errorf("Vary = %q, want the values joined", got)
+	}
+	// Cookie values can hold commas, so each is passed on by itself.
+	if got := res.Header.Values("Set-Cookie"); len(got) != 2 || got[0] != "a=1" || got[1] != "b=2; Expires=Wed, 21 Oct 2026 07:28:00 GMT" {
+		t.Errorf("Set-Cookie = %q, want both upstream cookies", got)
+	}
+}
+
+func TestReverseProxyHead(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "42")
+		if r.Method == "GET" {
+			w.Write([]byte(strings.Repeat("x", 42)))
+		}
+	}))
+	defer upstream.Close()
+	addr := startProxy(t, upstream.URL)
+
+	// The upstream's length is passed on for HEAD, and the connection stays
+	// in step for the request after it.
+	resp := rawRequest(t, addr, "HEAD /echo HTTP/1.1\r\nHost: x\r\n\r\nGET /echo HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	br := bufio.NewReader(strings.NewReader(resp))
+	res, err := http.ReadResponse(br, &http.Request{Method: "HEAD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Header.Get("Content-Length"); got != "42" {
+		t.Errorf("HEAD Content-Length = %q, want the upstream's 42", got)
+	}
+	if _, body := readResponse(t, br); len(body) != 42 {
+		t.Errorf("GET after HEAD has a body of %d bytes, want 42", len(body))
+	}
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	captureLog(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	addr := startProxy(t, upstream.URL)
+
+	// A deadline that has already passed gives up on the upstream.
+	if resp := rawRequest(t, addr, "GET /echo HTTP/1.1\r\nHost: x\r\nX-Request-Deadline: 1\r\nConnection: close\r\n\r\n"); !strings.HasPrefix(resp, "HTTP/1.1 504 ") {
+		t.Errorf("past deadline: response = %q, want 504", resp)
+	}
+
+	upstream.Close()
+	if resp := rawRequest(t, addr, "GET /echo HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"); !strings.HasPrefix(resp, "HTTP/1.1 502 ") {
+		t.Errorf("upstream down: response = %q, want 502", resp)
+	}
+}
+
+func TestMaxForwards(t *testing.T) {
+	tests := []struct {
+		header string
+		n      int
+		ok     bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{" 5 ", 5, true},
+		{"-1", 0, false},
+		{"two", 0, false},
+	}
+	for _, tt := range tests {
+		r := newTestRequest("OPTIONS", "*", map[string]string{"Max-Forwards": tt.header}, "")
+		if n, ok := r.MaxForwards(); n != tt.n || ok != tt.ok {
+			t.Errorf("Max-Forwards %q: MaxForwards() = %d, %v; want %d, %v", tt.header, n, ok, tt.n, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// ratelimit.go
+// This file contains a per-client rate limiter. Each client gets a token
+// bucket per route, and routes can have their own limits, so e.g. /login
+// can be held to a few attempts a minute while the rest of the site stays
+// generous.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit allows Requests requests per Per, e.g. {5, time.Minute}. Bursts
+// of up to Requests are let through as long as the average holds.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// RateLimitConfig sets the limits of RateLimitMiddleware.
+type RateLimitConfig struct {
+	// Default applies to routes without a limit of their own, and to
+	// requests that didn't match any route. The zero value means no limit.
+	Default RateLimit
+	// Routes holds limits by route pattern as registered, e.g. "/login" or
+	// "/users/:id" (see Request.RoutePattern).
+	Routes map[string]RateLimit
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // When the bucket will have refilled completely.
+}
+
+// take refills the bucket for the time since it was last used and takes a
+// token. If it is empty it returns how long until the next token.
+func (b *tokenBucket) take(limit RateLimit, now time.Time) (bool, time.Duration) {
+	rate := float64(limit.Requests) / float64(limit.Per)
+	b.tokens = math.Min(float64(limit.Requests), b.tokens+rate*float64(now.Sub(b.last)))
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate)
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(limit.Requests) - b.tokens) / rate))
+	return true, 0
+}
+
+// RateLimitMiddleware limits each client, identified by Request.ClientIP, per
+// route pattern. Requests over the limit get a 429 with Retry-After.
+func RateLimitMiddleware(config RateLimitConfig) Middleware {
+	var mu sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+	lastSweep := time.Now()
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			limit, ok := config.Routes[r.RoutePattern()]
+			if !ok {
+				limit = config.Default
+			}
+			if limit.Requests <= 0 || limit.Per <= 0 {
+				next(w, r)
+				return
+			}
+			key := r.RoutePattern() + " " + r.ClientIP()
+			now := time.Now()
+
+			mu.Lock()
+			// Buckets that have refilled completely are the same as new ones,
+			// so they are dropped now and then to keep the map small.
+			if now.Sub(lastSweep) > time.Minute {
+				for k, b := range buckets {
+					if now.After(b.full) {
+						delete(buckets, k)
+					}
+				}
+				lastSweep = now
+			}
+			b, ok := buckets[key]
+			if !ok {
+				b = &tokenBucket{tokens: float64(limit.Requests), last: now}
+				buckets[key] = b
+			}
+			allowed, retryAfter := b.take(limit, now)
+			mu.Unlock()
+
+			if !allowed {
+				w.SetHeader("Retry-After", fmt.Sprint(int(math.Ceil(max(retryAfter, time.Second).Seconds()))))
+				httpError(w, r, 429)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
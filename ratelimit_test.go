@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	s := NewServer("")
+	s.Use(RateLimitMiddleware(RateLimitConfig{
+		Default: RateLimit{Requests: 5, Per: time.Minute},
+		Routes: map[string]RateLimit{
+			"/login":     {Requests: 2, Per: time.Minute},
+			"/users/:id": {Requests: 3, Per: time.Minute},
+		},
+	}))
+	ok := func(w ResponseWriter, r *Request) { w.Write([]byte("ok")) }
+	s.Handle("POST", "/login", ok)
+	s.Handle("GET", "/", ok)
+	s.Handle("GET", "/users/:id", ok)
+	addr := startServer(t, s)
+	status := func(method, path string) string {
+		resp := rawRequest(t, addr, method+" "+path+" HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		code, _, _ := strings.Cut(strings.TrimPrefix(resp, "HTTP/1.1 "), " ")
+		return code
+	}
+
+	for i, want := range []string{"200", "200", "429", "429"} {
+		if got := status("POST", "/login"); got != want {
+			t.Errorf("login %d: status = %s, want %s", i, got, want)
+		}
+	}
+	// The strict login limit doesn't touch the rest of the site.
+	for i, want := range []string{"200", "200", "200", "200", "200", "429"} {
+		if got := status("GET", "/"); got != want {
+			t.Errorf("home %d: status = %s, want %s", i, got, want)
+		}
+	}
+	// A route's limit covers all paths that match its pattern.
+	for i, path := range []string{"/users/1", "/users/2", "/users/3", "/users/4"} {
+		want := "200"
+		if i == 3 {
+			want = "429"
+		}
+		if got := status("GET", path); got != want {
+			t.Errorf("%s: status = %s, want %s", path, got, want)
+		}
+	}
+
+	resp := rawRequest(t, addr, "POST /login HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	if !strings.Contains(resp, "\r\nRetry-After: 30\r\n") {
+		t.Errorf("response = %q, want Retry-After: 30", resp)
+	}
+}
@@ -0,0 +1,123 @@
+// recorder.go
+// This file contains a ResponseWriter that captures a response in memory
+// instead of sending it. Middleware that needs to store, share or replay a
+// response (idempotency, request coalescing) builds on it.
+
+package main
+
+import (
+	"bytes"
+	"slices"
+	"time"
+)
+
+// StoredResponse is a complete response captured by a recorder.
+type StoredResponse struct {
+	Status  int
+	Headers map[string]string
+	Body    []byte
+
+	// MoreHeaders holds the values of a header after the first, as added
+	// with AddHeader.
+	MoreHeaders map[string][]string
+
+	// RequestHash fingerprints the request that was answered, so that
+	// IdempotencyMiddleware can tell a retry from a different request
+	// reusing its key. It isn't part of the response.
+	RequestHash string
+}
+
+// writeTo replays the stored response onto w.
+func (sr *StoredResponse) writeTo(w ResponseWriter) {
+	for key, value := range sr.Headers {
+		w.SetHeader(key, value)
+		for _, more := range sr.MoreHeaders[key] {
+			w.AddHeader(key, more)
+		}
+	}
+	w.WriteHeader(sr.Status)
+	w.Write(sr.Body)
+}
+
+type responseRecorder struct {
+	status      int
+	headers     map[string]string
+	moreHeaders map[string][]string
+	body        bytes.Buffer
+	wroteHeader bool
+	firstWrite  time.Time
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{
+		status:  200,
+		headers: make(map[string]string),
+	}
+}
+
+func (rec *responseRecorder) SetHeader(key, value string) {
+	rec.headers[key] = value
+	delete(rec.moreHeaders, key)
+}
+
+func (rec *responseRecorder) AddHeader(key, value string) {
+	if _, ok := rec.headers[key]; !ok {
+		rec.headers[key] = value
+		return
+	}
+	if rec.moreHeaders == nil {
+		rec.moreHeaders = make(map[string][]string)
+	}
+	rec.moreHeaders[key] = append(rec.moreHeaders[key], value)
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.status = statusCode
+	rec.wroteHeader = true
+	rec.firstWrite = time.Now()
+}
+
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(rec.status)
+	}
+	return rec.body.Write(data)
+}
+
+// Flush is a no-op; a recorded response is only sent when it is replayed.
+func (rec *responseRecorder) Flush() {}
+
+func (rec *responseRecorder) Status() int {
+	return rec.status
+}
+
+// SetTrailer is a no-op; trailers aren't part of a recorded response.
+func (rec *responseRecorder) SetTrailer(key, value string) {}
+
+func (rec *responseRecorder) FirstWrite() time.Time {
+	return rec.firstWrite
+}
+
+// result returns a copy of everything recorded so far.
+func (rec *responseRecorder) result() *StoredResponse {
+	headers := make(map[string]string, len(rec.headers))
+	for key, value := range rec.headers {
+		headers[key] = value
+	}
+	var moreHeaders map[string][]string
+	for key, values := range rec.moreHeaders {
+		if moreHeaders == nil {
+			moreHeaders = make(map[string][]string, len(rec.moreHeaders))
+		}
+		moreHeaders[key] = slices.Clone(values)
+	}
+	return &StoredResponse{
+		Status:      rec.status,
+		Headers:     headers,
+		MoreHeaders: moreHeaders,
+		Body:        bytes.Clone(rec.body.Bytes()),
+	}
+}
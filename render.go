@@ -0,0 +1,86 @@
+// render.go
+// This file contains helpers for writing common kinds of response bodies,
+// so handlers don't have to repeat the content type and error handling.
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"time"
+)
+
+// RenderTemplate executes tmpl straight into the response with the given
+// status and an HTML content type. If execution fails before any output was
+// produced, a 500 is sent instead, through the error page registered for it
+// if any. Once output has started the status can't change anymore, so the
+// error is only logged and returned.
+func RenderTemplate(w ResponseWriter, r *Request, status int, tmpl *template.Template, data any) error {
+	w.SetHeader("Content-Type", "text/html; charset=utf-8")
+	lw := &lazyStatusWriter{ResponseWriter: w, status: status}
+	err := tmpl.Execute(lw, data)
+	if err != nil {
+		log.Printf("Error rendering template %q: %v", tmpl.Name(), err)
+		if !lw.started {
+			httpError(w, r, 500)
+		}
+		return err
+	}
+	if !lw.started {
+		w.WriteHeader(status)
+	}
+	return nil
+}
+
+// lazyStatusWriter holds the status code back until the first byte is written.
+type lazyStatusWriter struct {
+	ResponseWriter
+	status  int
+	started bool
+}
+
+func (lw *lazyStatusWriter) Write(data []byte) (int, error) {
+	if !lw.started {
+		lw.started = true
+		lw.ResponseWriter.WriteHeader(lw.status)
+	}
+	return lw.ResponseWriter.Write(data)
+}
+
+// problem is a problem details object as defined by RFC 7807.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// WriteProblem sends an error as an RFC 7807 problem details object, which
+// API clients can parse instead of scraping a plain-text message. The type is
+// "about:blank", meaning the status code says all there is to say about the
+// kind of problem; detail explains this occurrence and may be empty.
+func WriteProblem(w ResponseWriter, status int, title, detail string) {
+	// Strings and ints always marshal.
+	body, _ := json.Marshal(problem{Type: "about:blank", Title: title, Status: status, Detail: detail})
+	w.SetHeader("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// ServeCachedContent sends an in-memory page that last changed at modTime,
+// e.g. one generated now and then. It sets Last-Modified, and a client whose
+// If-Modified-Since is not older than modTime gets a 304 instead of the
+// body. A zero modTime turns this into a plain 200.
+func ServeCachedContent(w ResponseWriter, r *Request, body []byte, contentType string, modTime time.Time) {
+	if !modTime.IsZero() {
+		w.SetHeader("Last-Modified", modTime.UTC().Format(TimeFormat))
+		if notModified(r, modTime) {
+			w.WriteHeader(304)
+			return
+		}
+	}
+	w.SetHeader("Content-Type", contentType)
+	w.WriteHeader(200)
+	w.Write(body)
+}
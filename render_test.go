@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	tmpl := template.Must(template.New("page").Funcs(template.FuncMap{
+		"fail": func() (string, error) { return "", errors.New("failed") },
+	}).Parse(`{{define "ok"}}<p>Hello, {{.}}</p>{{end}}` +
+		`{{define "early"}}{{fail}}{{end}}` +
+		`{{define "late"}}<p>partial</p>{{fail}}{{end}}`))
+	render := func(name string, status int, data any) (*StoredResponse, error) {
+		rec := newResponseRecorder()
+		err := RenderTemplate(rec, newTestRequest("GET", "/", nil, ""), status, tmpl.Lookup(name), data)
+		return rec.result(), err
+	}
+
+	t.Run("success", func(t *testing.T) {
+		res, err := render("ok", 201, "<world>")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != 201 || string(res.Body) != "<p>Hello, &lt;world&gt;</p>" {
+			t.Errorf("response = %d %q", res.Status, res.Body)
+		}
+		if ct := res.Headers["Content-Type"]; ct != "text/html; charset=utf-8" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+	})
+
+	t.Run("error before output", func(t *testing.T) {
+		res, err := render("early", 200, nil)
+		if err == nil {
+			t.Error("no error returned")
+		}
+		if res.Status != 500 {
+			t.Errorf("status = %d, want 500", res.Status)
+		}
+	})
+
+	t.Run("error after output", func(t *testing.T) {
+		// The status is already sent, so only the error reports the failure.
+		res, err := render("late", 200, nil)
+		if err == nil {
+			t.Error("no error returned")
+		}
+		if res.Status != 200 || string(res.Body) != "<p>partial</p>" {
+			t.Errorf("response = %d %q, want the partial 200", res.Status, res.Body)
+		}
+	})
+}
+
+func TestWriteProblem(t *testing.T) {
+	rec := newResponseRecorder()
+	WriteProblem(rec, 400, "Bad Request", `field "email" is required`)
+	res := rec.result()
+	if res.Status != 400 || res.Headers["Content-Type"] != "application/problem+json" {
+		t.Errorf("response = %d %q, want 400 application/problem+json", res.Status, res.Headers["Content-Type"])
+	}
+	var got map[string]any
+	if err := json.Unmarshal(res.Body, &got); err != nil {
+		t.Fatalf("body %q: %v", res.Body, err)
+	}
+	want := map[string]any{"type": "about:blank", "title": "Bad Request", "status": 400.0, "detail": `field "email" is required`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("body = %v, want %v", got, want)
+	}
+}
+
+func TestProblemDetailsDefault(t *testing.T) {
+	s := NewServer("")
+	s.ProblemDetails = true
+	addr := startServer(t, s)
+
+	resp := rawRequest(t, addr, "GET /missing HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if !strings.Contains(resp, "\r\nContent-Type: application/problem+json\r\n") || !strings.HasSuffix(resp, `{"type":"about:blank","title":"Not Found","status":404}`) {
+		t.Errorf("response = %q, want a problem details 404", resp)
+	}
+}
+
+func TestServeCachedContent(t *testing.T) {
+	modTime := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+	serve := func(method string, headers map[string]string) *StoredResponse {
+		rec := newResponseRecorder()
+		ServeCachedContent(rec, newTestRequest(method, "/report", headers, ""), []byte("<p>report</p>"), "text/html", modTime)
+		return rec.result()
+	}
+
+	res := serve("GET", nil)
+	if res.Status != 200 || string(res.Body) != "<p>report</p>" || res.Headers["Content-Type"] != "text/html" {
+		t.Errorf("fresh request: response = %d %q %v", res.Status, res.Body, res.Headers)
+	}
+	if lm := res.Headers["Last-Modified"]; lm != "Sun, 01 Mar 2026 12:00:00 GMT" {
+		t.Errorf("Last-Modified = %q", lm)
+	}
+
+	tests := []struct {
+		since  string
+		status int
+	}{
+		{"Sun, 01 Mar 2026 12:00:00 GMT", 304},
+		{"Mon, 02 Mar 2026 00:00:00 GMT", 304},
+		{"Sat, 28 Feb 2026 12:00:00 GMT", 200},
+		{"not a date", 200},
+	}
+	for _, tt := range tests {
+		res := serve("GET", map[string]string{"If-Modified-Since": tt.since})
+		if res.Status != tt.status {
+			t.Errorf("If-Modified-Since %q: status = %d, want %d", tt.since, res.Status, tt.status)
+		}
+		if tt.status == 304 && len(res.Body) != 0 {
+			t.Errorf("If-Modified-Since %q: 304 with a body %q", tt.since, res.Body)
+		}
+	}
+
+	// Only GET and HEAD are conditional.
+	if res := serve("POST", map[string]string{"If-Modified-Since": "Mon, 02 Mar 2026 00:00:00 GMT"}); res.Status != 200 {
+		t.Errorf("POST: status = %d, want 200", res.Status)
+	}
+	// Without a modification time there is nothing to compare.
+	rec := newResponseRecorder()
+	ServeCachedContent(rec, newTestRequest("GET", "/", map[string]string{"If-Modified-Since": "Mon, 02 Mar 2026 00:00:00 GMT"}, ""), []byte("x"), "text/plain", time.Time{})
+	if res := rec.result(); res.Status != 200 || res.Headers["Last-Modified"] != "" {
+		t.Errorf("zero modTime: response = %d with Last-Modified %q, want a plain 200", res.Status, res.Headers["Last-Modified"])
+	}
+}
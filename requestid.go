@@ -0,0 +1,62 @@
+// requestid.go
+// This file contains request ID generation. Every request gets an ID that
+// is echoed back in the X-Request-ID response header so a client report can
+// be matched to the server's logs.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"sync"
+)
+
+// RequestIDGenerator produces request IDs from a source of random bytes.
+type RequestIDGenerator struct {
+	mu   sync.Mutex // Most readers aren't safe for concurrent use.
+	rand io.Reader
+}
+
+// NewRequestIDGenerator returns a generator reading from src. A nil src uses
+// crypto/rand; tests can pass a fixed reader to get predictable IDs.
+func NewRequestIDGenerator(src io.Reader) *RequestIDGenerator {
+	if src == nil {
+		src = rand.Reader
+	}
+	return &RequestIDGenerator{rand: src}
+}
+
+// NewID returns 16 random bytes from the source, hex encoded.
+func (g *RequestIDGenerator) NewID() (string, error) {
+	var buf [16]byte
+	g.mu.Lock()
+	_, err := io.ReadFull(g.rand, buf[:])
+	g.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// RequestIDMiddleware makes sure every request has an X-Request-ID header,
+// keeping one sent by the client, and echoes it on the response.
+func RequestIDMiddleware(gen *RequestIDGenerator) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			id := r.Headers["X-Request-Id"]
+			if id == "" {
+				var err error
+				if id, err = gen.NewID(); err != nil {
+					log.Printf("Error generating request ID: %v", err)
+					httpError(w, r, 500)
+					return
+				}
+				r.Headers["X-Request-Id"] = id
+			}
+			w.SetHeader("X-Request-ID", id)
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDGeneratorFixedSource(t *testing.T) {
+	src := bytes.NewReader(bytes.Repeat([]byte{0xab}, 16))
+	id, err := NewRequestIDGenerator(src).NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("ab", 16); id != want {
+		t.Errorf("id = %q, want %q", id, want)
+	}
+}
+
+func TestRequestIDGeneratorShortSource(t *testing.T) {
+	gen := NewRequestIDGenerator(bytes.NewReader(make([]byte, 20)))
+	if _, err := gen.NewID(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gen.NewID(); err == nil {
+		t.Error("an exhausted source gave an ID")
+	}
+}
+
+func TestRequestIDGeneratorDefaultSource(t *testing.T) {
+	gen := NewRequestIDGenerator(nil)
+	a, err := gen.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := gen.NewID()
+	if len(a) != 32 || a == b {
+		t.Errorf("ids %q and %q, want two distinct 32-digit ids", a, b)
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	gen := NewRequestIDGenerator(bytes.NewReader(bytes.Repeat([]byte{0x01}, 16)))
+	var seen string
+	h := RequestIDMiddleware(gen)(func(w ResponseWriter, r *Request) {
+		seen = r.Headers["X-Request-Id"]
+	})
+
+	resp := serveRecorded(h, newTestRequest("GET", "/", nil, ""))
+	if want := strings.Repeat("01", 16); seen != want || resp.Headers["X-Request-ID"] != want {
+		t.Errorf("handler saw %q, response has %q, want %q", seen, resp.Headers["X-Request-ID"], want)
+	}
+	resp = serveRecorded(h, newTestRequest("GET", "/", map[string]string{"X-Request-ID": "client-id"}, ""))
+	if seen != "client-id" || resp.Headers["X-Request-ID"] != "client-id" {
+		t.Errorf("client's id not kept: handler saw %q, response has %q", seen, resp.Headers["X-Request-ID"])
+	}
+}
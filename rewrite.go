@@ -0,0 +1,66 @@
+// rewrite.go
+// This file contains path rewriting for URL migrations. Rules map old paths
+// to new ones either internally, so the request is routed as if the new path
+// had been requested, or by redirecting the client to the new URL.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// RewriteRule describes one rewrite. Set either Prefix or Pattern.
+type RewriteRule struct {
+	// Prefix matches paths starting with it, and Replacement takes its place,
+	// e.g. Prefix "/old/" and Replacement "/new/" turn "/old/a" into "/new/a".
+	Prefix string
+	// Pattern matches paths against a regular expression, and Replacement is
+	// expanded like regexp.ReplaceAllString, so it can use $1 and so on.
+	Pattern *regexp.Regexp
+	// Replacement is the new prefix or the expansion template.
+	Replacement string
+	// Redirect, if non-zero, is the status code (e.g. 301) of a redirect sent
+	// to the client instead of rewriting the request internally.
+	Redirect int
+}
+
+// rewrite returns the rewritten path and whether the rule matched.
+func (rule RewriteRule) rewrite(path string) (string, bool) {
+	if rule.Pattern != nil {
+		if !rule.Pattern.MatchString(path) {
+			return "", false
+		}
+		return rule.Pattern.ReplaceAllString(path, rule.Replacement), true
+	}
+	if rule.Prefix != "" && strings.HasPrefix(path, rule.Prefix) {
+		return rule.Replacement + strings.TrimPrefix(path, rule.Prefix), true
+	}
+	return "", false
+}
+
+// RewriteMiddleware applies the first rule matching the request path. An
+// internal rewrite changes r.Path and the request is routed again with the
+// new path; a redirect rule answers with the new URL, keeping the query.
+func RewriteMiddleware(rules []RewriteRule) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			for _, rule := range rules {
+				path, ok := rule.rewrite(r.Path)
+				if !ok {
+					continue
+				}
+				if rule.Redirect != 0 {
+					if r.RawQuery != "" {
+						path += "?" + r.RawQuery
+					}
+					Redirect(w, r, path, rule.Redirect)
+					return
+				}
+				r.Path = path
+				break
+			}
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRewriteMiddleware(t *testing.T) {
+	s := NewServer("")
+	s.Use(RewriteMiddleware([]RewriteRule{
+		{Prefix: "/old/", Replacement: "/new/"},
+		{Pattern: regexp.MustCompile(`^/posts/(\d+)$`), Replacement: "/articles/$1"},
+		{Prefix: "/legacy/", Replacement: "/new/", Redirect: 301},
+	}))
+	s.Handle("GET", "/new/:name", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("new " + r.Param("name") + " " + r.Query("v")))
+	})
+	s.Handle("GET", "/articles/:id", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("article " + r.Param("id")))
+	})
+	addr := startServer(t, s)
+	get := func(target string) (int, string, string) {
+		resp := rawRequest(t, addr, "GET "+target+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		res, body := readResponse(t, bufio.NewReader(strings.NewReader(resp)))
+		return res.StatusCode, res.Header.Get("Location"), body
+	}
+
+	tests := []struct {
+		target   string
+		status   int
+		location string
+		body     string
+	}{
+		{"/old/page?v=2", 200, "", "new page 2"},
+		{"/posts/42", 200, "", "article 42"},
+		{"/posts/abc", 404, "", ""},
+		{"/legacy/page?v=2", 301, "/new/page?v=2", ""},
+		{"/new/page", 200, "", "new page "},
+	}
+	for _, tt := range tests {
+		status, location, body := get(tt.target)
+		if status != tt.status || location != tt.location || (tt.body != "" && body != tt.body) {
+			t.Errorf("%s: response = %d %q %q, want %d %q %q", tt.target, status, location, body, tt.status, tt.location, tt.body)
+		}
+	}
+}
@@ -6,12 +6,22 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -19,17 +29,46 @@ import (
 type HandlerFunc func(w ResponseWriter, r *Request)
 type Middleware func(next HandlerFunc) HandlerFunc
 
-// Router holds the mappings of routes to their handlers.
+// ConnState describes where a client connection is in its lifecycle. It is
+// reported to the hook registered with SetConnState.
+type ConnState int
+
+const (
+	StateNew    ConnState = iota // Accepted, no request read yet.
+	StateActive                  // A request is being handled.
+	StateIdle                    // Waiting for the next request on a kept-alive connection.
+	StateClosed                  // The connection has been closed.
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case StateNew: return "new"
+	case StateActive: return "active"
+	case StateIdle: return "idle"
+	case StateClosed: return "closed"
+	default: return "unknown"
+	}
+}
+
+// Router holds the mappings of routes to their handlers. A route path may
+// have parameter segments like "/users/:id", which match any single segment
+// and make its value available through r.Param("id").
 type Router struct {
 	routes         map[string]map[string]HandlerFunc
+	patterns       []string // Registered paths with parameter segments, in registration order.
 	notFoundHandler HandlerFunc
+	methodNotAllowedHandler HandlerFunc
+	methodMismatchHandlers  map[string]HandlerFunc // Per-path 405 handlers, by registered path.
 }
 
 func NewRouter() *Router {
 	return &Router{
 		routes: make(map[string]map[string]HandlerFunc),
 		notFoundHandler: func(w ResponseWriter, r *Request) {
-			httpError(w, 404) // The default not found handler-version
+			httpError(w, r, 404) // The default not found handler-version
+		},
+		methodNotAllowedHandler: func(w ResponseWriter, r *Request) {
+			httpError(w, r, 405)
 		},
 	}
 }
@@ -39,40 +78,235 @@ func (rt *Router) Handle(method, path string, handler HandlerFunc) {
 	if rt.routes[method] == nil {
 		rt.routes[method] = make(map[string]HandlerFunc)
 	}
+	if strings.Contains(path, "/:") && !rt.registered(path) {
+		rt.patterns = append(rt.patterns, path)
+	}
 	rt.routes[method][path] = handler
 }
 
+// registered reports whether path has a handler for any method.
+func (rt *Router) registered(path string) bool {
+	for _, methodHandlers := range rt.routes {
+		if _, ok := methodHandlers[path]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (rt *Router) SetNotFoundHandler(handler HandlerFunc) {
 	rt.notFoundHandler = handler
 }
 
-func (rt *Router) findHandler(method, path string) HandlerFunc {
-	if methodHandlers, ok := rt.routes[method]; ok {
-		if handler, ok := methodHandlers[path]; ok {
+// SetMethodNotAllowedHandler replaces the handler used when the path matches
+// a route but the method doesn't. The Allow header is already set when it
+// runs, and r.AllowedMethods() lists the methods the path does accept.
+func (rt *Router) SetMethodNotAllowedHandler(handler HandlerFunc) {
+	rt.methodNotAllowedHandler = handler
+}
+
+// HandleMethodMismatch registers the handler used instead of the method not
+// allowed handler when a request matches path, as registered with Handle,
+// but not its method; e.g. to explain which method to use. As with the
+// general one, the Allow header is set when it runs, and r.Path and
+// r.AllowedMethods() tell what was asked for and what would have worked.
+func (rt *Router) HandleMethodMismatch(path string, handler HandlerFunc) {
+	if rt.methodMismatchHandlers == nil {
+		rt.methodMismatchHandlers = make(map[string]HandlerFunc)
+	}
+	rt.methodMismatchHandlers[path] = handler
+}
+
+// findHandler returns the handler for r and records the matched route on it.
+// A path registered as is wins over parameterized routes, which are tried in
+// the order they were registered.
+func (rt *Router) findHandler(r *Request) HandlerFunc {
+	r.allowedMethods = nil
+	r.routePattern = ""
+	r.params = nil
+
+	if handler, ok := rt.routes[r.Method][r.Path]; ok {
+		r.routePattern = r.Path
+		return handler
+	}
+
+	// The path exists under other methods, so this is a 405 rather than a 404.
+	allowed := make(map[string]bool)
+	rt.addAllowed(allowed, r.Path)
+	mismatch := rt.methodMismatchHandlers[r.Path]
+	for _, pattern := range rt.patterns {
+		params, ok := matchPattern(pattern, r.Path)
+		if !ok {
+			continue
+		}
+		if handler, ok := rt.routes[r.Method][pattern]; ok {
+			r.routePattern = pattern
+			r.params = params
 			return handler
 		}
+		rt.addAllowed(allowed, pattern)
+		if mismatch == nil {
+			mismatch = rt.methodMismatchHandlers[pattern]
+		}
+	}
+	if len(allowed) == 0 {
+		return rt.notFoundHandler
+	}
+	for method := range allowed {
+		r.allowedMethods = append(r.allowedMethods, method)
+	}
+	sort.Strings(r.allowedMethods)
+	allowHeader := strings.Join(r.allowedMethods, ", ")
+	if mismatch == nil {
+		mismatch = rt.methodNotAllowedHandler
+	}
+	return func(w ResponseWriter, r *Request) {
+		w.SetHeader("Allow", allowHeader)
+		mismatch(w, r)
+	}
+}
+
+// addAllowed adds the methods that have a handler for path to allowed.
+func (rt *Router) addAllowed(allowed map[string]bool, path string) {
+	for method, methodHandlers := range rt.routes {
+		if _, ok := methodHandlers[path]; ok {
+			allowed[method] = true
+		}
 	}
-	return rt.notFoundHandler
+}
+
+// matchPattern matches path against a route pattern segment by segment. A
+// ":name" segment matches any non-empty segment, whose value is returned
+// under name.
+func matchPattern(pattern, path string) (map[string]string, bool) {
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(path, "/")
+	if len(patternSegments) != len(pathSegments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, segment := range patternSegments {
+		if name, ok := strings.CutPrefix(segment, ":"); ok && pathSegments[i] != "" {
+			params[name] = pathSegments[i]
+		} else if segment != pathSegments[i] {
+			return nil, false
+		}
+	}
+	return params, true
 }
 
 // Server is the core of our web server.
 type Server struct {
 	Addr       string
-	router     *Router
-	middleware []Middleware
-	wg         sync.WaitGroup
+
+	// MaxHeaderValueBytes caps the length of any single header value.
+	// Requests exceeding it are rejected with 431. Zero disables the check.
+	MaxHeaderValueBytes int
+
+	// MaxHeaderBytes caps the request line and headers together. A request
+	// line over it is rejected with 414, and headers that go past it with
+	// 431, before the rest of them is read. Zero disables the check.
+	MaxHeaderBytes int
+
+	// MaxBodySize caps the size of a request body in bytes. A larger declared
+	// Content-Length is rejected with 413, and reading a chunked body past it
+	// fails with ErrBodyTooLarge. Zero disables the check.
+	MaxBodySize int64
+
+	// DisableKeepAlive closes every connection after a single request,
+	// whatever the client asked for.
+	DisableKeepAlive bool
+
+	// DefaultContentType is sent as the Content-Type of any response whose
+	// handler didn't set one. Empty means no Content-Type is added.
+	DefaultContentType string
+
+	// ResponseWriteTimeout caps how long sending a response may take, from
+	// its headers to the last byte of the body. A response that doesn't get
+	// through in time is abandoned and the connection closed, so a slow
+	// client can't hold on to a connection forever. Zero means no limit.
+	ResponseWriteTimeout time.Duration
+
+	// ProblemDetails makes the default error responses RFC 7807 problem
+	// details (see WriteProblem) instead of plain text. Pages registered with
+	// SetErrorPage still take precedence.
+	ProblemDetails bool
+
+	// MaxRequestDeadline caps how far ahead a deadline sent by the client
+	// in X-Request-Deadline may lie; NewServer sets it to a minute. Zero
+	// leaves client deadlines as sent.
+	MaxRequestDeadline time.Duration
+
+	// EnableH2C lets clients switch a connection to HTTP/2 over cleartext,
+	// by prior knowledge or with "Upgrade: h2c" (see h2c.go). It is off by
+	// default, and those requests are served as HTTP/1.x.
+	EnableH2C bool
+
+	// MaxConns caps how many connections are served at once; kept-alive
+	// connections hold on to their slot while idle. Zero means no limit.
+	MaxConns int
+
+	// ConnWaitTimeout is how long a connection over MaxConns waits for a
+	// slot to free up. If none does, it gets a 503 and is closed. Zero
+	// rejects it right away.
+	ConnWaitTimeout time.Duration
+
+	// OnReload is called when the process gets SIGHUP, e.g. to reread the
+	// configuration or swap in new routes with ReplaceRouter. It must be set
+	// before ListenAndServe; without it SIGHUP isn't caught.
+	OnReload func()
+
+	// TLSConfig is used by ListenAndServeTLS, e.g. to set MinVersion,
+	// CipherSuites or NextProtos (ALPN). It is cloned, not modified. Nil
+	// means the crypto/tls defaults.
+	TLSConfig *tls.Config
+
+	router         atomic.Pointer[Router]
+	middleware     []Middleware
+	connState      func(net.Conn, ConnState)
+	errorPages     map[int]HandlerFunc
+	preHandler     func(w ResponseWriter, r *Request) bool
+	trustedProxies []netip.Prefix
+	inShutdown     atomic.Bool
+	activeRequests atomic.Int64
+
+	mu        sync.Mutex
+	listeners map[net.Listener]*trackedListener
+
+	shutdownOnce sync.Once
+	shuttingDown chan struct{} // Closed when shutdown starts.
+
+	// Virtual hosts, see HandleHost. unknownHost has no routes; its not
+	// found handler answers requests for every other host.
+	hosts       map[string]*Router
+	unknownHost *Router
+
+	slotsOnce sync.Once
+	connSlots chan struct{} // Holds a token per connection being served, up to MaxConns.
 }
 
 func NewServer(addr string) *Server {
-	return &Server{
-		Addr:   addr,
-		router: NewRouter(),
+	s := &Server{
+		Addr:                addr,
+		MaxHeaderValueBytes: 8 << 10,
+		MaxHeaderBytes:      1 << 20,
+		MaxBodySize:         10 << 20,
+		MaxRequestDeadline:  time.Minute,
+		errorPages:          make(map[int]HandlerFunc),
+		listeners:           make(map[net.Listener]*trackedListener),
+		shuttingDown:        make(chan struct{}),
 	}
+	s.router.Store(NewRouter())
+	s.unknownHost = NewRouter()
+	s.unknownHost.SetNotFoundHandler(func(w ResponseWriter, r *Request) {
+		httpError(w, r, 421)
+	})
+	return s
 }
 
 // Called by our server from main file, this in turn calls the routers handle function above
 func (s *Server) Handle(method, path string, handler HandlerFunc) {
-	s.router.Handle(method, path, handler)
+	s.router.Load().Handle(method, path, handler)
 }
 
 func (s *Server) Use(mw Middleware) {
@@ -80,70 +314,387 @@ func (s *Server) Use(mw Middleware) {
 }
 
 func (s *Server) SetNotFoundHandler(handler HandlerFunc) {
-	s.router.SetNotFoundHandler(handler)
+	s.router.Load().SetNotFoundHandler(handler)
+}
+
+func (s *Server) SetMethodNotAllowedHandler(handler HandlerFunc) {
+	s.router.Load().SetMethodNotAllowedHandler(handler)
 }
 
+func (s *Server) HandleMethodMismatch(path string, handler HandlerFunc) {
+	s.router.Load().HandleMethodMismatch(path, handler)
+}
+
+// HandleHost serves requests for host (see Request.Host; any port is
+// ignored) with rt instead of the server's own router. Registering a host
+// puts the server in virtual-host mode, where requests for hosts without a
+// router go to the unknown host handler, a 421 unless replaced with
+// SetUnknownHostHandler.
+func (s *Server) HandleHost(host string, rt *Router) {
+	if s.hosts == nil {
+		s.hosts = make(map[string]*Router)
+	}
+	s.hosts[hostname(host)] = rt
+}
+
+// SetUnknownHostHandler replaces the handler for requests to hosts that have
+// no router in virtual-host mode, e.g. to redirect them to the main site.
+// It has no effect until a host is registered with HandleHost.
+func (s *Server) SetUnknownHostHandler(handler HandlerFunc) {
+	s.unknownHost.SetNotFoundHandler(handler)
+}
+
+// hostname lowercases host and strips its port, if any.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// ReplaceRouter swaps in a whole new route table while the server runs.
+// Requests already being handled finish with the router they started with,
+// and new ones use rt. rt must be fully set up beforehand: a router isn't
+// safe to change while it serves requests, which is also why Handle and the
+// other route setters are only for use before the server starts.
+func (s *Server) ReplaceRouter(rt *Router) {
+	s.router.Store(rt)
+}
+
+// SetPreHandler registers a hook that runs on every request before routing,
+// e.g. to resolve a tenant or normalize the path. It may modify the request,
+// and the router sees the result. Returning false means the hook has already
+// responded, and the request ends there without reaching the router or any
+// middleware.
+func (s *Server) SetPreHandler(pre func(w ResponseWriter, r *Request) bool) {
+	s.preHandler = pre
+}
+
+// SetErrorPage registers a handler that renders the body of every error
+// response with the given status code, replacing the plain-text default.
+// The status code is already fixed when the handler runs.
+func (s *Server) SetErrorPage(code int, handler HandlerFunc) {
+	s.errorPages[code] = handler
+}
+
+// SetConnState registers a hook that is called every time a connection
+// changes state. It is meant for diagnostics and must not block.
+func (s *Server) SetConnState(hook func(net.Conn, ConnState)) {
+	s.connState = hook
+}
+
+// ListenAndServe listens on s.Addr and serves until a shutdown signal
+// (SIGINT or SIGTERM) arrives, then waits for open connections to finish.
+// If OnReload is set, SIGHUP calls it instead of ending the process.
 func (s *Server) ListenAndServe() error {
 	listener, err := net.Listen("tcp", s.Addr)
 	if err != nil {
 		return err
 	}
-	defer listener.Close()
+	defer s.handleSignals()()
+	return s.Serve(listener)
+}
+
+// ListenAndServeTLS is ListenAndServe over TLS, with the certificate and
+// private key read from PEM files. The handshake follows s.TLSConfig. Only
+// HTTP/1.x is served over TLS, so ALPN offers just "http/1.1" unless
+// NextProtos says otherwise.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	}
+	// Clone shares the caller's Certificates array, which append could write into.
+	config.Certificates = append(slices.Clone(config.Certificates), cert)
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer s.handleSignals()()
+	return s.Serve(tls.NewListener(listener, config))
+}
 
-	shutdownCtx, shutdownRelease := context.WithCancel(context.Background())
-	go s.handleShutdownSignal(shutdownRelease)
+// handleSignals starts handleShutdownSignal for the signals the server
+// reacts to. They are caught until the server starts shutting down, however
+// that happens, or the returned function is called; after that they have
+// their usual effect again, so a second Ctrl+C ends a slow drain.
+func (s *Server) handleSignals() (stop func()) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	if s.OnReload != nil {
+		signal.Notify(sigCh, syscall.SIGHUP)
+	}
+	stopped := make(chan struct{})
+	go s.handleShutdownSignal(sigCh, stopped)
+	return func() { close(stopped) }
+}
 
+// Exists/runs in the background and shuts down the server after a shudown-signal like ctrl + C, etc.
+// SIGHUP only triggers a reload, and the server keeps going.
+func (s *Server) handleShutdownSignal(sigCh chan os.Signal, stopped <-chan struct{}) {
+	defer signal.Stop(sigCh)
 	for {
 		select {
-		case <-shutdownCtx.Done():
-			s.wg.Wait()
-			return nil
-		default:
-			listener.(*net.TCPListener).SetDeadline(time.Now().Add(1 * time.Second))
-			conn, err := listener.Accept()
-			if err != nil {
-				// If the deadline is hit, a timeout error occurs and we loop again to avoid being stuck.
-				if os.IsTimeout(err) {
-					continue
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				log.Println("Reload signal received.")
+				if s.OnReload != nil {
+					s.OnReload()
 				}
-				return err
+				continue
 			}
+			log.Println("Shutdown signal received, stopping new connections.")
+			s.shutdown()
+			return
+		case <-s.shuttingDown:
+			return
+		case <-stopped:
+			return
+		}
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn, tl *trackedListener) {
+	defer tl.wg.Done()
+	reader := newBufioReader(conn)
+	writer := newBufioWriter(conn)
+	defer func() {
+		conn.Close()
+		s.setState(tl, conn, StateClosed)
+		putBufioReader(reader)
+		putBufioWriter(writer)
+	}()
+
+	if !s.acquireConnSlot() {
+		log.Printf("Connection limit of %d reached, rejecting %s", s.MaxConns, conn.RemoteAddr())
+		resp := newResponse(conn, writer)
+		resp.closeConn = true
+		httpError(resp, &Request{Headers: make(map[string]string), Conn: conn, server: s}, 503)
+		resp.finish()
+		closeWriteAndWait(conn)
+		return
+	}
+	defer s.releaseConnSlot()
+
+	for {
+		// Wait for the start of the next request. A client that goes away or
+		// stays idle past the deadline simply gets its connection closed.
+		// Shutting down the listener cuts the wait short.
+		//
+		// This is the only place EOF ends the connection. Nothing reads from
+		// the connection while a request is handled, except for its body, so
+		// a client that half-closes its write side right after sending the
+		// request still gets the whole response.
+		conn.SetReadDeadline(time.Now().Add(requestReadTimeout))
+		if tl.stopping.Load() {
+			return
+		}
+		if _, err := reader.Peek(1); err != nil {
+			return
+		}
+		s.setState(tl, conn, StateActive)
+
+		req, err := parseRequest(conn, reader, requestLimits{
+			maxHeaderBytes:      s.MaxHeaderBytes,
+			maxHeaderValueBytes: s.MaxHeaderValueBytes,
+			maxBodyBytes:        s.MaxBodySize,
+		})
+		if err != nil {
+			log.Printf("Error parsing request: %v", err)
+			code := 400
+			var netErr net.Error
+			if reqErr, ok := err.(*requestError); ok {
+				code = reqErr.code
+			} else if errors.As(err, &netErr) && netErr.Timeout() {
+				// The request started arriving but stalled past the deadline.
+				code = 408
+			}
+			// There's no parsed request, but error pages still get a usable one.
+			resp := newResponse(conn, writer)
+			resp.closeConn = true
+			httpError(resp, &Request{Headers: make(map[string]string), Conn: conn, server: s}, code)
+			resp.finish()
+			closeWriteAndWait(conn)
+			return
+		}
+
+		req.server = s
+
+		if s.EnableH2C && (isH2CPreface(req) || isH2CUpgrade(req)) {
+			s.serveH2C(conn, reader, req)
+			return
+		}
+
+		ctx, cancel := s.requestContext(req)
+		req.ctx = ctx
+
+		// newResponse function creates a Response struct
+		resp := newResponse(conn, writer)
+		resp.defaultContentType = s.DefaultContentType
+		resp.writeTimeout = s.ResponseWriteTimeout
+		resp.cancel = cancel
+		resp.closeConn = !s.keepAlive(req) || tl.stopping.Load()
+		resp.noChunking = req.Version != "HTTP/1.1"
+		resp.head = req.Method == "HEAD"
+		if !resp.closeConn && req.Version == "HTTP/1.0" {
+			resp.headers["Connection"] = "keep-alive"
+		}
+		if cr, ok := req.body.(*continueReader); ok {
+			cr.resp = resp
+		}
+		s.serveRequest(resp, req)
+		err = resp.finish()
+		cancel()
+		if err != nil {
+			log.Printf("Error writing response: %v", err)
+			return
+		}
+		if resp.closeConn || headerHasToken(resp.headers["Connection"], "close") {
+			return
+		}
+		conn.SetWriteDeadline(time.Time{})
+		// Whatever the handler left of the body has to go before the next
+		// request can be read.
+		if !req.discardBody() {
+			return
+		}
+		s.setState(tl, conn, StateIdle)
+	}
+}
 
-			s.wg.Add(1)
-			go s.handleConnection(conn)
+// requestContext returns the context for req. A client can send a deadline
+// as a unix timestamp in seconds in X-Request-Deadline, e.g. for the time
+// it will give up waiting; the context then expires at that time, or after
+// MaxRequestDeadline if that is sooner. Invalid values are ignored.
+func (s *Server) requestContext(req *Request) (context.Context, context.CancelFunc) {
+	secs, err := strconv.ParseInt(req.Headers["X-Request-Deadline"], 10, 64)
+	if err != nil || secs <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	deadline := time.Unix(secs, 0)
+	if s.MaxRequestDeadline > 0 {
+		if limit := time.Now().Add(s.MaxRequestDeadline); deadline.After(limit) {
+			deadline = limit
 		}
 	}
+	return context.WithDeadline(context.Background(), deadline)
 }
 
-// Exists/runs in the background and shuts down the server after a shudown-signal like ctrl + C, etc.
-func (s *Server) handleShutdownSignal(release func()) {
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
-	<-sigCh
-	log.Println("Shutdown signal received, stopping new connections.")
-	release()
+// closeWriteAndWait ends the sending side of a connection that is being
+// closed before the request on it was read in full, then discards what the
+// client still sends for a short while. Closing with unread data would reset
+// the connection, and the client could lose the response sent just before.
+func closeWriteAndWait(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	io.Copy(io.Discard, io.LimitReader(conn, maxDrainBytes))
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
-	defer s.wg.Done()
-	defer conn.Close()
+// requestReadTimeout is how long a connection may take to deliver the next
+// request line and headers, idle time included. It is a variable so tests
+// don't have to wait that long.
+var requestReadTimeout = 10 * time.Second
 
-	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	req, err := parseRequest(conn)
-	if err != nil {
-		log.Printf("Error parsing request: %v", err)
-		httpError(newResponse(conn), 400)
-		return
+// bodyReadTimeout is how long reading a request body may wait for more of it
+// to arrive. The headers' deadline doesn't apply to the body, which may take
+// much longer to upload than requestReadTimeout.
+var bodyReadTimeout = 10 * time.Second
+
+// The buffered readers and writers of closed connections are kept for new
+// ones, which saves allocating two fresh buffers per connection under high
+// connection churn.
+var (
+	bufioReaderPool sync.Pool
+	bufioWriterPool sync.Pool
+)
+
+func newBufioReader(conn net.Conn) *bufio.Reader {
+	if br, ok := bufioReaderPool.Get().(*bufio.Reader); ok {
+		br.Reset(conn)
+		return br
 	}
+	return bufio.NewReader(conn)
+}
 
-	handler := s.router.findHandler(req.Method, req.Path)
+// putBufioReader returns br to the pool. Resetting it drops whatever was
+// still buffered, so nothing carries over to the next connection.
+func putBufioReader(br *bufio.Reader) {
+	br.Reset(nil)
+	bufioReaderPool.Put(br)
+}
+
+func newBufioWriter(conn net.Conn) *bufio.Writer {
+	if bw, ok := bufioWriterPool.Get().(*bufio.Writer); ok {
+		bw.Reset(conn)
+		return bw
+	}
+	return bufio.NewWriter(conn)
+}
+
+func putBufioWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	bufioWriterPool.Put(bw)
+}
+
+// keepAlive reports whether the connection may be reused after answering req.
+func (s *Server) keepAlive(req *Request) bool {
+	if s.DisableKeepAlive {
+		return false
+	}
+	connection := req.Headers["Connection"]
+	switch req.Version {
+	case "HTTP/1.1":
+		return !headerHasToken(connection, "close")
+	case "HTTP/1.0":
+		return headerHasToken(connection, "keep-alive")
+	}
+	return false
+}
+
+// ActiveRequests returns how many requests are being handled right now. It
+// is meant to be polled, e.g. to watch requests drain during shutdown.
+func (s *Server) ActiveRequests() int {
+	return int(s.activeRequests.Load())
+}
+
+// serveRequest routes req and runs the matched handler wrapped in all middleware.
+func (s *Server) serveRequest(w ResponseWriter, req *Request) {
+	s.activeRequests.Add(1)
+	defer s.activeRequests.Add(-1)
+	if s.preHandler != nil && !s.preHandler(w, req) {
+		return
+	}
+	router := s.router.Load()
+	if s.hosts != nil {
+		router = s.unknownHost
+		if rt, ok := s.hosts[hostname(req.Host())]; ok {
+			router = rt
+		}
+	}
+	matched := router.findHandler(req)
+	path := req.Path
+	handler := func(w ResponseWriter, r *Request) {
+		// Middleware rewrote the path (see RewriteMiddleware), so the
+		// handler for the new path runs instead.
+		if r.Path != path {
+			matched = router.findHandler(r)
+		}
+		matched(w, r)
+	}
 
 	// Wraps all the middlewares we have, like an onion layer around the main handler.
 	for i := len(s.middleware) - 1; i >= 0; i-- {
 		handler = s.middleware[i](handler)
 	}
-
-	// newResponse function creates a Response struct
-	resp := newResponse(conn)
-	handler(resp, req)
+	handler(w, req)
 }
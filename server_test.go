@@ -0,0 +1,921 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startServer serves s on a free local port until the test ends and
+// returns the address it listens on.
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Serve(l)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		s.Stop()
+		<-done
+	})
+	return l.Addr().String()
+}
+
+// rawRequest sends raw on a new connection to addr and returns everything
+// the server sends back until it closes the connection.
+func rawRequest(t *testing.T, addr, raw string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// readResponse reads one response off br with net/http's parser and
+// returns it with its body read in full.
+func readResponse(t *testing.T, br *bufio.Reader) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+// logBuffer collects log output, which the server writes from its own goroutines.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *logBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.String()
+}
+
+// captureLog sends the log package's output to a buffer until the test ends.
+func captureLog(t *testing.T) *logBuffer {
+	lb := &logBuffer{}
+	log.SetOutput(lb)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return lb
+}
+
+func TestRequestDeadline(t *testing.T) {
+	s := NewServer("")
+	s.MaxRequestDeadline = time.Hour
+	deadlines := make(chan time.Time, 1)
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		d, _ := r.Context().Deadline()
+		deadlines <- d
+	})
+	addr := startServer(t, s)
+
+	now := time.Now().Unix()
+	tests := []struct {
+		name   string
+		header string
+		want   time.Time // Zero means no deadline.
+	}{
+		{"none", "", time.Time{}},
+		{"in a minute", strconv.FormatInt(now+60, 10), time.Unix(now+60, 0)},
+		{"past", strconv.FormatInt(now-5, 10), time.Unix(now-5, 0)},
+		{"not a number", "soon", time.Time{}},
+		{"negative", "-3", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n"
+			if tt.header != "" {
+				raw += "X-Request-Deadline: " + tt.header + "\r\n"
+			}
+			rawRequest(t, addr, raw+"\r\n")
+			if got := <-deadlines; !got.Equal(tt.want) {
+				t.Errorf("deadline = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("capped", func(t *testing.T) {
+		start := time.Now()
+		rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\nX-Request-Deadline: "+strconv.FormatInt(now+86400, 10)+"\r\n\r\n")
+		got := <-deadlines
+		if got.Before(start.Add(time.Hour)) || got.After(time.Now().Add(time.Hour)) {
+			t.Errorf("deadline = %v, want an hour from the request", got)
+		}
+	})
+}
+
+func TestDefaultMaxRequestDeadline(t *testing.T) {
+	if got := NewServer("").MaxRequestDeadline; got <= 0 {
+		t.Errorf("NewServer MaxRequestDeadline = %v, want a limit", got)
+	}
+}
+
+func TestConnState(t *testing.T) {
+	s := NewServer("")
+	states := make(chan ConnState, 10)
+	s.SetConnState(func(conn net.Conn, state ConnState) {
+		states <- state
+	})
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("ok"))
+	})
+	addr := startServer(t, s)
+
+	rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	want := []ConnState{StateNew, StateActive, StateClosed}
+	for i, w := range want {
+		select {
+		case got := <-states:
+			if got != w {
+				t.Fatalf("transition %d = %v, want %v", i, got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("transition %d: timed out waiting for %v", i, w)
+		}
+	}
+	select {
+	case got := <-states:
+		t.Errorf("unexpected transition to %v", got)
+	default:
+	}
+}
+
+func TestConnStateKeepAlive(t *testing.T) {
+	s := NewServer("")
+	states := make(chan ConnState, 10)
+	s.SetConnState(func(conn net.Conn, state ConnState) {
+		states <- state
+	})
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("ok"))
+	})
+	addr := startServer(t, s)
+
+	rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\n\r\nGET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	want := []ConnState{StateNew, StateActive, StateIdle, StateActive, StateClosed}
+	for i, w := range want {
+		select {
+		case got := <-states:
+			if got != w {
+				t.Fatalf("transition %d = %v, want %v", i, got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("transition %d: timed out waiting for %v", i, w)
+		}
+	}
+}
+
+func TestSetErrorPage(t *testing.T) {
+	captureLog(t)
+	s := NewServer("")
+	s.SetErrorPage(404, func(w ResponseWriter, r *Request) {
+		w.SetHeader("Content-Type", "text/html")
+		w.Write([]byte("<h1>No " + r.Path + " here</h1>"))
+	})
+	s.SetErrorPage(500, func(w ResponseWriter, r *Request) {
+		w.Write([]byte("something broke"))
+	})
+	s.Handle("GET", "/broken", func(w ResponseWriter, r *Request) {
+		httpError(w, r, 500)
+	})
+	bad := template.Must(template.New("bad").Parse("{{.Missing.Field}}"))
+	s.Handle("GET", "/template", func(w ResponseWriter, r *Request) {
+		RenderTemplate(w, r, 200, bad, struct{}{})
+	})
+	s.Handle("GET", "/forbidden", func(w ResponseWriter, r *Request) {
+		httpError(w, r, 403)
+	})
+	addr := startServer(t, s)
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/nowhere", 404, "<h1>No /nowhere here</h1>"},
+		{"/broken", 500, "something broke"},
+		{"/template", 500, "something broke"},
+		{"/forbidden", 403, "403 Forbidden"}, // No page registered: the default.
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp := rawRequest(t, addr, "GET "+tt.path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+			res, body := readResponse(t, bufio.NewReader(strings.NewReader(resp)))
+			if res.StatusCode != tt.status || strings.TrimSpace(body) != tt.body {
+				t.Errorf("response = %d %q, want %d %q", res.StatusCode, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestDisableKeepAlive(t *testing.T) {
+	s := NewServer("")
+	s.DisableKeepAlive = true
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("ok"))
+	})
+	addr := startServer(t, s)
+
+	for _, raw := range []string{
+		"GET / HTTP/1.1\r\nHost: x\r\n\r\nGET / HTTP/1.1\r\nHost: x\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: x\r\nConnection: keep-alive\r\n\r\nGET / HTTP/1.1\r\nHost: x\r\n\r\n",
+		"GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET / HTTP/1.0\r\n\r\n",
+	} {
+		// The connection is closed after the first response, so the
+		// pipelined second request is never answered.
+		resp := rawRequest(t, addr, raw)
+		if n := strings.Count(resp, "HTTP/1.1 200 OK"); n != 1 {
+			t.Errorf("got %d responses on one connection, want 1: %q", n, resp)
+		}
+		if !strings.Contains(resp, "\r\nConnection: close\r\n") {
+			t.Errorf("response without Connection: close: %q", resp)
+		}
+	}
+}
+
+func TestMethodNotAllowedHandlerAllowedMethods(t *testing.T) {
+	s := NewServer("")
+	s.SetMethodNotAllowedHandler(func(w ResponseWriter, r *Request) {
+		body, _ := json.Marshal(map[string]any{"error": "method not allowed", "allowed": r.AllowedMethods()})
+		w.SetHeader("Content-Type", "application/json")
+		w.WriteHeader(405)
+		w.Write(body)
+	})
+	noop := func(w ResponseWriter, r *Request) {}
+	s.Handle("GET", "/users/:id", noop)
+	s.Handle("DELETE", "/users/:id", noop)
+	s.Handle("PUT", "/users/me", noop)
+	addr := startServer(t, s)
+
+	resp := rawRequest(t, addr, "POST /users/me HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	res, body := readResponse(t, bufio.NewReader(strings.NewReader(resp)))
+	if res.StatusCode != 405 || res.Header.Get("Allow") != "DELETE, GET, PUT" {
+		t.Errorf("response = %d with Allow %q, want 405 with DELETE, GET, PUT", res.StatusCode, res.Header.Get("Allow"))
+	}
+	var got struct{ Allowed []string }
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatalf("body %q: %v", body, err)
+	}
+	if strings.Join(got.Allowed, ",") != "DELETE,GET,PUT" {
+		t.Errorf("allowed in body = %v, want [DELETE GET PUT]", got.Allowed)
+	}
+}
+
+func TestHandleMethodMismatch(t *testing.T) {
+	s := NewServer("")
+	noop := func(w ResponseWriter, r *Request) {}
+	s.Handle("POST", "/login", noop)
+	s.Handle("GET", "/users/:id", noop)
+	s.Handle("GET", "/items", noop)
+	explain := func(w ResponseWriter, r *Request) {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "%s only takes %s", r.Path, strings.Join(r.AllowedMethods(), " or "))
+	}
+	s.HandleMethodMismatch("/login", explain)
+	s.HandleMethodMismatch("/users/:id", explain)
+	addr := startServer(t, s)
+
+	tests := []struct {
+		request, body string
+	}{
+		{"GET /login", "/login only takes POST"},
+		{"PUT /users/7", "/users/7 only takes GET"},
+		// Paths without their own handler still get the general one.
+		{"POST /items", "405 Method Not Allowed"},
+	}
+	for _, tt := range tests {
+		resp := rawRequest(t, addr, tt.request+" HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		res, body := readResponse(t, bufio.NewReader(strings.NewReader(resp)))
+		if res.StatusCode != 405 || res.Header.Get("Allow") == "" || body != tt.body {
+			t.Errorf("%s: response = %d with Allow %q, body %q; want 405 with Allow and %q", tt.request, res.StatusCode, res.Header.Get("Allow"), body, tt.body)
+		}
+	}
+}
+
+func TestSetPreHandler(t *testing.T) {
+	s := NewServer("")
+	middlewareRan := make(chan string, 10)
+	s.Use(func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			middlewareRan <- r.Path
+			next(w, r)
+		}
+	})
+	s.SetPreHandler(func(w ResponseWriter, r *Request) bool {
+		if r.Headers["X-Blocked"] != "" {
+			w.WriteHeader(403)
+			return false
+		}
+		// Strip a tenant prefix: /acme/users/7 is routed as /users/7.
+		if tenant, rest, ok := strings.Cut(strings.TrimPrefix(r.Path, "/"), "/"); ok {
+			r.Set("tenant", tenant)
+			r.Path = "/" + rest
+		}
+		return true
+	})
+	s.Handle("GET", "/users/:id", func(w ResponseWriter, r *Request) {
+		w.Write([]byte(r.Get("tenant").(string) + " user " + r.Param("id")))
+	})
+	addr := startServer(t, s)
+
+	resp := rawRequest(t, addr, "GET /acme/users/7 HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	if res, body := readResponse(t, bufio.NewReader(strings.NewReader(resp))); res.StatusCode != 200 || body != "acme user 7" {
+		t.Errorf("rewritten request: response = %d %q, want 200 %q", res.StatusCode, body, "acme user 7")
+	}
+	if got := <-middlewareRan; got != "/users/7" {
+		t.Errorf("middleware saw %q, want the rewritten path", got)
+	}
+
+	resp = rawRequest(t, addr, "GET /acme/users/7 HTTP/1.1\r\nHost: x\r\nX-Blocked: 1\r\nConnection: close\r\n\r\n")
+	if !strings.HasPrefix(resp, "HTTP/1.1 403 ") {
+		t.Errorf("aborted request: response = %q, want the pre-handler's 403", resp)
+	}
+	select {
+	case got := <-middlewareRan:
+		t.Errorf("middleware ran for %q after the pre-handler aborted", got)
+	default:
+	}
+}
+
+// readConn is a connection that reads from r and discards writes.
+type readConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestBufioPoolDoesNotLeak(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		br := newBufioReader(readConn{r: strings.NewReader("GET / HTTP/1.1\r\nleftover from the first connection")})
+		if _, err := br.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		bw := newBufioWriter(readConn{})
+		bw.WriteString("unflushed")
+		putBufioReader(br)
+		putBufioWriter(bw)
+
+		br = newBufioReader(readConn{r: strings.NewReader("second")})
+		if data, _ := io.ReadAll(br); string(data) != "second" {
+			t.Fatalf("pooled reader read %q, want only the new connection's data", data)
+		}
+		if bw = newBufioWriter(readConn{}); bw.Buffered() != 0 {
+			t.Fatalf("pooled writer holds %d bytes from an old connection", bw.Buffered())
+		}
+		putBufioReader(br)
+		putBufioWriter(bw)
+	}
+}
+
+// BenchmarkConnBuffers compares the buffers' allocations per connection with
+// and without the pools.
+func BenchmarkConnBuffers(b *testing.B) {
+	src := strings.NewReader(benchRequest)
+	var conn net.Conn = readConn{r: src}
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			src.Reset(benchRequest)
+			br, bw := newBufioReader(conn), newBufioWriter(conn)
+			br.ReadString('\n')
+			bw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+			bw.Flush()
+			putBufioReader(br)
+			putBufioWriter(bw)
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			src.Reset(benchRequest)
+			br, bw := bufio.NewReader(conn), bufio.NewWriter(conn)
+			br.ReadString('\n')
+			bw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+			bw.Flush()
+		}
+	})
+}
+
+func TestClientHalfClose(t *testing.T) {
+	s := NewServer("")
+	s.Handle("GET", "/slow", func(w ResponseWriter, r *Request) {
+		// The client's FIN arrives while the handler is still working.
+		time.Sleep(20 * time.Millisecond)
+		w.Write(bytes.Repeat([]byte("x"), 100<<10))
+	})
+	addr := startServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: x\r\n\r\n")
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, body := readResponse(t, br)
+	if res.StatusCode != 200 || len(body) != 100<<10 {
+		t.Errorf("response = %d with %d bytes, want 200 with %d", res.StatusCode, len(body), 100<<10)
+	}
+	// With nothing more to read, the server closes its side too.
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("after the response: err = %v, want EOF", err)
+	}
+}
+
+func TestResponseWriteTimeout(t *testing.T) {
+	const size = 64 << 20 // Far more than the socket buffers hold.
+	s := NewServer("")
+	s.ResponseWriteTimeout = 100 * time.Millisecond
+	writeErr := make(chan error, 1)
+	s.Handle("GET", "/large", func(w ResponseWriter, r *Request) {
+		w.SetHeader("Content-Length", strconv.Itoa(size))
+		chunk := make([]byte, 64<<10)
+		for sent := 0; sent < size; sent += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	})
+	s.Handle("GET", "/small", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("small"))
+	})
+	addr := startServer(t, s)
+
+	// A client that doesn't read the response at all.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /large HTTP/1.1\r\nHost: x\r\n\r\n")
+	select {
+	case err := <-writeErr:
+		if err == nil {
+			t.Fatal("the whole response was written to a client that doesn't read")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the write wasn't aborted")
+	}
+	// The connection is closed, so the client gets less than it was promised.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.Copy(io.Discard, conn)
+	if err != nil || n >= size {
+		t.Errorf("client read %d bytes, err %v; want a cut-off response", n, err)
+	}
+
+	// Responses that are read promptly aren't affected.
+	if resp := rawRequest(t, addr, "GET /small HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"); !strings.HasSuffix(resp, "small") {
+		t.Errorf("small response = %q", resp)
+	}
+}
+
+func TestRoutePattern(t *testing.T) {
+	s := NewServer("")
+	patterns := make(chan string, 1)
+	// Middleware sees the pattern too, e.g. to label metrics with it.
+	s.Use(func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			next(w, r)
+			patterns <- r.RoutePattern()
+		}
+	})
+	noop := func(w ResponseWriter, r *Request) {}
+	s.Handle("GET", "/users/:id", noop)
+	s.Handle("GET", "/users/:id/posts/:post", noop)
+	s.Handle("GET", "/users/me", noop)
+	addr := startServer(t, s)
+
+	tests := []struct{ path, pattern string }{
+		{"/users/42", "/users/:id"},
+		{"/users/42/posts/7", "/users/:id/posts/:post"},
+		{"/users/me", "/users/me"},
+		{"/nowhere", ""},
+	}
+	for _, tt := range tests {
+		rawRequest(t, addr, "GET "+tt.path+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		if got := <-patterns; got != tt.pattern {
+			t.Errorf("%s: RoutePattern() = %q, want %q", tt.path, got, tt.pattern)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	captureLog(t)
+	defer func(d time.Duration) { requestReadTimeout = d }(requestReadTimeout)
+	requestReadTimeout = 100 * time.Millisecond
+	s := NewServer("")
+	addr := startServer(t, s)
+
+	// The client stalls in the middle of its headers.
+	start := time.Now()
+	resp := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nX-Partial: ")
+	if !strings.HasPrefix(resp, "HTTP/1.1 408 Request Timeout\r\n") || !strings.Contains(resp, "Connection: close") {
+		t.Errorf("response = %q, want a 408 that closes the connection", resp)
+	}
+	if elapsed := time.Since(start); elapsed < requestReadTimeout {
+		t.Errorf("answered after %v, before the read deadline", elapsed)
+	}
+
+	// A client that never starts a request is just disconnected.
+	if resp := rawRequest(t, addr, ""); resp != "" {
+		t.Errorf("idle connection: response = %q, want none", resp)
+	}
+	// A malformed request is still a 400.
+	if resp := rawRequest(t, addr, "NONSENSE\r\n\r\n"); !strings.HasPrefix(resp, "HTTP/1.1 400 ") {
+		t.Errorf("malformed request: response = %q, want 400", resp)
+	}
+}
+
+// TestReplaceRouter is meant to be run with -race.
+func TestReplaceRouter(t *testing.T) {
+	newVersion := func(v string, slow chan struct{}) *Router {
+		rt := NewRouter()
+		rt.Handle("GET", "/version", func(w ResponseWriter, r *Request) {
+			w.Write([]byte(v))
+		})
+		if slow != nil {
+			rt.Handle("GET", "/slow", func(w ResponseWriter, r *Request) {
+				<-slow
+				w.Write([]byte(v))
+			})
+		}
+		return rt
+	}
+	s := NewServer("")
+	slow := make(chan struct{})
+	s.ReplaceRouter(newVersion("v0", slow))
+	addr := startServer(t, s)
+
+	// A request routed before the swap finishes with the old handler.
+	slowConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slowConn.Close()
+	slowConn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(slowConn, "GET /slow HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	for s.ActiveRequests() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			br := bufio.NewReader(conn)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				io.WriteString(conn, "GET /version HTTP/1.1\r\nHost: x\r\n\r\n")
+				resp, err := http.ReadResponse(br, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != 200 || !strings.HasPrefix(string(body), "v") {
+					t.Errorf("response = %d %q during swaps", resp.StatusCode, body)
+					return
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 50; i++ {
+		s.ReplaceRouter(newVersion(fmt.Sprintf("v%d", i), nil))
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	close(slow)
+	if resp, _ := io.ReadAll(slowConn); !strings.HasSuffix(string(resp), "v0") {
+		t.Errorf("in-flight request: response = %q, want the old router's", resp)
+	}
+	if resp := rawRequest(t, addr, "GET /version HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"); !strings.HasSuffix(resp, "v50") {
+		t.Errorf("after the swaps: response = %q, want v50", resp)
+	}
+	// The old router's routes are gone.
+	if resp := rawRequest(t, addr, "GET /slow HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"); !strings.HasPrefix(resp, "HTTP/1.1 404 ") {
+		t.Errorf("old route: response = %q, want 404", resp)
+	}
+}
+
+func TestActiveRequests(t *testing.T) {
+	s := NewServer("")
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	s.Handle("GET", "/slow", func(w ResponseWriter, r *Request) {
+		close(entered)
+		<-release
+	})
+	addr := startServer(t, s)
+
+	if n := s.ActiveRequests(); n != 0 {
+		t.Fatalf("idle server: ActiveRequests() = %d, want 0", n)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		io.ReadAll(conn)
+	}()
+	<-entered
+	if n := s.ActiveRequests(); n != 1 {
+		t.Errorf("during the request: ActiveRequests() = %d, want 1", n)
+	}
+	// The count is what shutdown is waiting for.
+	s.Stop()
+	if n := s.ActiveRequests(); n != 1 {
+		t.Errorf("while draining: ActiveRequests() = %d, want 1", n)
+	}
+	close(release)
+	<-done
+	if n := s.ActiveRequests(); n != 0 {
+		t.Errorf("after the request: ActiveRequests() = %d, want 0", n)
+	}
+}
+
+func TestReloadSignal(t *testing.T) {
+	captureLog(t)
+	s := NewServer("")
+	reloads := make(chan struct{}, 1)
+	s.OnReload = func() { reloads <- struct{}{} }
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("ok"))
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		s.Serve(l)
+		close(served)
+	}()
+	defer s.Stop()
+
+	sigCh := make(chan os.Signal)
+	handled := make(chan struct{})
+	go func() {
+		s.handleShutdownSignal(sigCh, make(chan struct{}))
+		close(handled)
+	}()
+
+	sigCh <- syscall.SIGHUP
+	select {
+	case <-reloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnReload wasn't called")
+	}
+	if resp := rawRequest(t, l.Addr().String(), "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"); !strings.HasSuffix(resp, "ok") {
+		t.Errorf("after SIGHUP: response = %q, want the server still serving", resp)
+	}
+
+	sigCh <- syscall.SIGTERM
+	for name, done := range map[string]chan struct{}{"signal handling": handled, "Serve": served} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s didn't end after SIGTERM", name)
+		}
+	}
+}
+
+func TestHandleHost(t *testing.T) {
+	site := func(name string) *Router {
+		rt := NewRouter()
+		rt.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+			w.Write([]byte(name))
+		})
+		return rt
+	}
+	s := NewServer("")
+	s.HandleHost("example.com", site("example"))
+	s.HandleHost("API.example.com", site("api"))
+	addr := startServer(t, s)
+	get := func(host string) string {
+		return rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n")
+	}
+
+	for host, want := range map[string]string{"example.com": "example", "Example.COM:8080": "example", "api.example.com": "api"} {
+		if resp := get(host); !strings.HasSuffix(resp, "\r\n\r\n"+want) {
+			t.Errorf("Host %s: response = %q, want %q", host, resp, want)
+		}
+	}
+	if got := StatusText(421); got != "Misdirected Request" {
+		t.Errorf("StatusText(421) = %q", got)
+	}
+	if resp := get("other.test"); !strings.HasPrefix(resp, "HTTP/1.1 421 Misdirected Request\r\n") {
+		t.Errorf("unknown host: response = %q, want 421", resp)
+	}
+
+	s.SetUnknownHostHandler(func(w ResponseWriter, r *Request) {
+		Redirect(w, r, "https://example.com/", 302)
+	})
+	if resp := get("other.test"); !strings.HasPrefix(resp, "HTTP/1.1 302 ") || !strings.Contains(resp, "\r\nLocation: https://example.com/\r\n") {
+		t.Errorf("unknown host with handler: response = %q, want the redirect", resp)
+	}
+}
+
+func TestStop(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe() }()
+	// Stop before Serve has registered the listener wouldn't test much.
+	for listening := false; !listening; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		listening = len(s.listeners) == 1
+		s.mu.Unlock()
+	}
+
+	handled := make(chan struct{})
+	go func() {
+		s.handleShutdownSignal(make(chan os.Signal), make(chan struct{}))
+		close(handled)
+	}()
+
+	s.Stop()
+	s.Stop()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ListenAndServe = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe didn't return after Stop")
+	}
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("signal handling didn't end after Stop")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(l); err != nil {
+		t.Errorf("Serve after Stop = %v, want nil", err)
+	}
+	s.Stop()
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// to dir as PEM files.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeFiles(t, dir, map[string]string{
+		"cert.pem": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		"key.pem":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	})
+	return certFile, keyFile
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	captureLog(t)
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	s := NewServer("127.0.0.1:0")
+	// Room for one more certificate, which ListenAndServeTLS mustn't use.
+	certs := make([]tls.Certificate, 0, 1)
+	s.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS13, Certificates: certs}
+	s.Use(HTTPSRedirectMiddleware)
+	s.Handle("GET", "/", func(w ResponseWriter, r *Request) {
+		w.Write([]byte("secure"))
+	})
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServeTLS(certFile, keyFile) }()
+	var addr string
+	for addr == "" {
+		s.mu.Lock()
+		for l := range s.listeners {
+			addr = l.Addr().String()
+		}
+		s.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	defer func() {
+		s.Stop()
+		if err := <-served; err != nil {
+			t.Errorf("ListenAndServeTLS = %v", err)
+		}
+	}()
+
+	if _, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Error("TLS 1.2 handshake succeeded, want it rejected by MinVersion")
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if state := conn.ConnectionState(); state.Version != tls.VersionTLS13 || state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("negotiated version %x, protocol %q; want TLS 1.3 and http/1.1", state.Version, state.NegotiatedProtocol)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	// Over TLS, HTTPSRedirectMiddleware lets the request through.
+	if res, body := readResponse(t, bufio.NewReader(conn)); res.StatusCode != 200 || body != "secure" {
+		t.Errorf("response = %d %q, want 200 %q", res.StatusCode, body, "secure")
+	}
+
+	if spare := certs[:1][0]; spare.Certificate != nil {
+		t.Error("ListenAndServeTLS appended its certificate to s.TLSConfig.Certificates")
+	}
+}
@@ -0,0 +1,58 @@
+// singleflight.go
+// This file contains request coalescing. Concurrent requests that map to the
+// same key share a single run of the handler: the first one does the work and
+// the others wait for its recorded response instead of repeating it.
+
+package main
+
+import "sync"
+
+type flight struct {
+	done   chan struct{}
+	result *StoredResponse
+}
+
+// SingleFlightMiddleware runs the handler once for all in-flight requests
+// with the same key and sends every one of them the same response. Requests
+// for which keyFunc returns "" are handled normally. Only use it for
+// requests whose response doesn't depend on anything outside the key.
+func SingleFlightMiddleware(keyFunc func(*Request) string) Middleware {
+	var mu sync.Mutex
+	flights := make(map[string]*flight)
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			key := keyFunc(r)
+			if key == "" {
+				next(w, r)
+				return
+			}
+
+			mu.Lock()
+			if f, ok := flights[key]; ok {
+				mu.Unlock()
+				<-f.done
+				f.result.writeTo(w)
+				return
+			}
+			f := &flight{done: make(chan struct{})}
+			flights[key] = f
+			mu.Unlock()
+
+			rec := newResponseRecorder()
+			// Waiters are released even if the handler panics.
+			defer func() {
+				mu.Lock()
+				delete(flights, key)
+				mu.Unlock()
+				if f.result == nil {
+					f.result = &StoredResponse{Status: 500, Body: []byte("500 Internal Server Error")}
+				}
+				close(f.done)
+			}()
+			next(rec, r)
+			f.result = rec.result()
+			f.result.writeTo(w)
+		}
+	}
+}
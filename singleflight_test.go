@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSingleFlightMiddleware(t *testing.T) {
+	var runs atomic.Int32
+	release := make(chan struct{})
+	h := SingleFlightMiddleware(func(r *Request) string {
+		return r.Query("q")
+	})(func(w ResponseWriter, r *Request) {
+		n := runs.Add(1)
+		<-release
+		w.SetHeader("X-Run", fmt.Sprint(n))
+		fmt.Fprintf(w, "result for %s", r.Query("q"))
+	})
+
+	const n = 10
+	results := make(chan *StoredResponse, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- serveRecorded(h, newTestRequest("GET", "/search?q=go", nil, ""))
+		}()
+	}
+	// Give the other requests time to join the first one's flight.
+	for runs.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if got := runs.Load(); got != 1 {
+		t.Errorf("handler ran %d times, want 1", got)
+	}
+	for res := range results {
+		if res.Status != 200 || string(res.Body) != "result for go" || res.Headers["X-Run"] != "1" {
+			t.Errorf("response = %d %q %v, want the shared one", res.Status, res.Body, res.Headers)
+		}
+	}
+
+	// Once the flight has landed, the next request runs the handler again.
+	if res := serveRecorded(h, newTestRequest("GET", "/search?q=go", nil, "")); res.Headers["X-Run"] != "2" {
+		t.Errorf("later request: X-Run = %q, want a new run", res.Headers["X-Run"])
+	}
+	// Requests without a key aren't coalesced.
+	serveRecorded(h, newTestRequest("GET", "/search", nil, ""))
+	if got := runs.Load(); got != 3 {
+		t.Errorf("handler ran %d times, want 3", got)
+	}
+}
+
+func TestSingleFlightMiddlewarePanic(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	h := SingleFlightMiddleware(func(r *Request) string { return "k" })(func(w ResponseWriter, r *Request) {
+		close(entered)
+		<-release
+		panic("boom")
+	})
+
+	go func() {
+		defer func() { recover() }()
+		serveRecorded(h, newTestRequest("GET", "/", nil, ""))
+	}()
+	<-entered
+	waiter := make(chan *StoredResponse)
+	go func() { waiter <- serveRecorded(h, newTestRequest("GET", "/", nil, "")) }()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	select {
+	case res := <-waiter:
+		if res.Status != 500 {
+			t.Errorf("waiter status = %d, want 500", res.Status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter wasn't released after the handler panicked")
+	}
+}
@@ -0,0 +1,90 @@
+// timing.go
+// This file lets handlers time named steps of their work (a database query,
+// a template render) and report them to the client in a Server-Timing
+// header, where browser dev tools show them next to the network timings.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timingSpan is one finished span recorded with StartSpan.
+type timingSpan struct {
+	name     string
+	duration time.Duration
+}
+
+// StartSpan starts timing a step named name and returns the function that
+// ends it. The name should be a plain token like "db" or "render".
+//
+//	defer r.StartSpan("db")()
+//
+// Spans may be ended from other goroutines.
+func (r *Request) StartSpan(name string) func() {
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+		r.spansMu.Lock()
+		r.spans = append(r.spans, timingSpan{name: name, duration: d})
+		r.spansMu.Unlock()
+	}
+}
+
+// serverTiming formats the spans finished so far as a Server-Timing value,
+// with durations in milliseconds. It returns "" when there are none.
+func (r *Request) serverTiming() string {
+	r.spansMu.Lock()
+	defer r.spansMu.Unlock()
+	metrics := make([]string, len(r.spans))
+	for i, span := range r.spans {
+		metrics[i] = fmt.Sprintf("%s;dur=%.3f", span.name, float64(span.duration)/float64(time.Millisecond))
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// ServerTimingMiddleware sends the spans recorded with r.StartSpan in a
+// Server-Timing header. Headers go out with the status line, so only spans
+// that ended before the handler started its response are included.
+func ServerTimingMiddleware(next HandlerFunc) HandlerFunc {
+	return func(w ResponseWriter, r *Request) {
+		tw := &serverTimingWriter{ResponseWriter: w, r: r}
+		next(tw, r)
+		tw.setHeader()
+	}
+}
+
+// serverTimingWriter adds the Server-Timing header just before the status
+// line is written.
+type serverTimingWriter struct {
+	ResponseWriter
+	r    *Request
+	done bool
+}
+
+func (tw *serverTimingWriter) setHeader() {
+	if tw.done {
+		return
+	}
+	tw.done = true
+	if timing := tw.r.serverTiming(); timing != "" {
+		tw.ResponseWriter.SetHeader("Server-Timing", timing)
+	}
+}
+
+func (tw *serverTimingWriter) WriteHeader(code int) {
+	tw.setHeader()
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *serverTimingWriter) Write(data []byte) (int, error) {
+	tw.setHeader()
+	return tw.ResponseWriter.Write(data)
+}
+
+func (tw *serverTimingWriter) Flush() {
+	tw.setHeader()
+	tw.ResponseWriter.Flush()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServerTimingMiddleware(t *testing.T) {
+	h := ServerTimingMiddleware(func(w ResponseWriter, r *Request) {
+		end := r.StartSpan("db")
+		time.Sleep(5 * time.Millisecond)
+		end()
+		func() {
+			defer r.StartSpan("render")()
+			time.Sleep(2 * time.Millisecond)
+		}()
+		w.Write([]byte("ok"))
+		// Too late for the header.
+		r.StartSpan("late")()
+	})
+	res := serveRecorded(h, newTestRequest("GET", "/", nil, ""))
+
+	header := res.Headers["Server-Timing"]
+	metric := regexp.MustCompile(`(\w+);dur=(\d+\.\d{3})`)
+	matches := metric.FindAllStringSubmatch(header, -1)
+	if len(matches) != 2 || matches[0][1] != "db" || matches[1][1] != "render" {
+		t.Fatalf("Server-Timing = %q, want db and render", header)
+	}
+	for i, min := range []float64{5, 2} {
+		if ms, _ := strconv.ParseFloat(matches[i][2], 64); ms < min {
+			t.Errorf("%s took %vms, want at least %vms", matches[i][1], ms, min)
+		}
+	}
+
+	res = serveRecorded(ServerTimingMiddleware(func(w ResponseWriter, r *Request) {}), newTestRequest("GET", "/", nil, ""))
+	if _, ok := res.Headers["Server-Timing"]; ok {
+		t.Errorf("no spans: Server-Timing = %q, want no header", res.Headers["Server-Timing"])
+	}
+}